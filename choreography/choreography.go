@@ -0,0 +1,379 @@
+// Package choreography describes servo strike patterns as data and plays them
+// on a PCA9685 servo controller.
+//
+// A sequence is a list of steps. Each step wakes or sleeps the controller, or
+// moves a channel to a position between the instrument's rest and strike
+// points, a PWM value or an angle, and then holds for a duration. Sequences
+// are loaded from JSON, e.g.
+//
+//	{
+//	  "sequences": {
+//	    "bell": {"steps": [
+//	      {"action": "wake", "hold": "100ms"},
+//	      {"position": 1, "hold": "450ms"},
+//	      {"position": 0, "hold": "400ms", "ease": "in-out"},
+//	      {"action": "sleep"}
+//	    ]}
+//	  }
+//	}
+//
+// YAML is not supported: there is no YAML parser among the vendored
+// packages. As JSON is valid YAML, a file can be kept in a YAML-aware editor
+// as long as it sticks to JSON syntax.
+package choreography
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// Step actions.
+const (
+	ActionSet   = "set"
+	ActionWake  = "wake"
+	ActionSleep = "sleep"
+)
+
+// Easings.
+const (
+	// EaseNone jumps straight to the target.
+	EaseNone = "none"
+	// EaseLinear moves to the target at a constant rate over the hold.
+	EaseLinear = "linear"
+	// EaseInOut accelerates and then decelerates over the hold.
+	EaseInOut = "in-out"
+)
+
+// easeFrame is how often an eased move updates the channel.
+const easeFrame = 20 * time.Millisecond
+
+// Step is one step of a sequence.
+type Step struct {
+	// Action is ActionSet, the default, ActionWake or ActionSleep.
+	Action string `json:"action,omitempty"`
+	// Channel is the controller channel to move. Nil means the channel of the
+	// instrument the sequence is played on.
+	Channel *int `json:"channel,omitempty"`
+	// Position is where to move the instrument, from 0 at rest to 1 at the
+	// strike point. It cannot be used with Channel.
+	Position *float64 `json:"position,omitempty"`
+	// PWM is the off time to set, out of 4096. It is ignored if Position or
+	// Angle is set.
+	PWM *int `json:"pwm,omitempty"`
+	// Angle is the servo angle to set, from 0 to 180 degrees, mapped to a
+	// 0.5ms to 2.5ms pulse.
+	Angle *float64 `json:"angle,omitempty"`
+	// Hold is how long to wait after the step starts before the next one.
+	Hold Duration `json:"hold,omitempty"`
+	// Ease is how a set step moves from the channel's last value to the new
+	// one over Hold. The default is EaseNone.
+	Ease string `json:"ease,omitempty"`
+}
+
+// Sequence is a named strike pattern.
+type Sequence struct {
+	Name  string `json:"-"`
+	Steps []Step `json:"steps"`
+}
+
+// Duration is a time.Duration that reads from JSON as either a string such as
+// "450ms" or a number of milliseconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	var ms float64
+	if err := json.Unmarshal(data, &ms); err != nil {
+		return fmt.Errorf("duration must be a string or a number of milliseconds: %s", data)
+	}
+	*d = Duration(ms * float64(time.Millisecond))
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Library holds sequences by name.
+type Library map[string]*Sequence
+
+type libraryFile struct {
+	Sequences map[string]*Sequence `json:"sequences"`
+}
+
+// Parse reads sequences from JSON and checks them.
+func Parse(data []byte) (Library, error) {
+	f := libraryFile{}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	lib := make(Library)
+	for name, seq := range f.Sequences {
+		if seq == nil {
+			return nil, fmt.Errorf("sequence %s is empty", name)
+		}
+		seq.Name = name
+		if err := seq.Validate(); err != nil {
+			return nil, err
+		}
+		lib[name] = seq
+	}
+	return lib, nil
+}
+
+// Load reads the sequences in the file at path on top of the bundled
+// defaults, so a file only needs to define the sequences it adds or changes.
+func Load(path string) (Library, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	lib := Defaults()
+	for name, seq := range loaded {
+		lib[name] = seq
+	}
+	return lib, nil
+}
+
+// Get returns the sequence called name.
+func (l Library) Get(name string) (*Sequence, error) {
+	seq, ok := l[name]
+	if !ok {
+		return nil, fmt.Errorf("choreography: no sequence %q", name)
+	}
+	return seq, nil
+}
+
+// Validate checks that every step is well formed.
+func (s *Sequence) Validate() error {
+	for i, step := range s.Steps {
+		switch step.Action {
+		case "", ActionSet, ActionWake, ActionSleep:
+		default:
+			return fmt.Errorf("sequence %s step %d: unknown action %q", s.Name, i, step.Action)
+		}
+		switch step.Ease {
+		case "", EaseNone, EaseLinear, EaseInOut:
+		default:
+			return fmt.Errorf("sequence %s step %d: unknown easing %q", s.Name, i, step.Ease)
+		}
+		if step.Channel != nil && (*step.Channel < 0 || *step.Channel > 15) {
+			return fmt.Errorf("sequence %s step %d: channel %d out of range", s.Name, i, *step.Channel)
+		}
+		if (step.Action == "" || step.Action == ActionSet) && step.Position == nil && step.PWM == nil && step.Angle == nil {
+			return fmt.Errorf("sequence %s step %d: no position, pwm or angle to set", s.Name, i)
+		}
+		if step.Position != nil && step.Channel != nil {
+			return fmt.Errorf("sequence %s step %d: position cannot be used with channel", s.Name, i)
+		}
+		if step.Position != nil && (*step.Position < 0 || *step.Position > 1) {
+			return fmt.Errorf("sequence %s step %d: position %g out of range", s.Name, i, *step.Position)
+		}
+		if step.Angle != nil && (*step.Angle < 0 || *step.Angle > 180) {
+			return fmt.Errorf("sequence %s step %d: angle %g out of range", s.Name, i, *step.Angle)
+		}
+		if step.PWM != nil && (*step.PWM < 0 || *step.PWM > 4095) {
+			return fmt.Errorf("sequence %s step %d: pwm %d out of range", s.Name, i, *step.PWM)
+		}
+		if step.Hold < 0 {
+			return fmt.Errorf("sequence %s step %d: negative hold", s.Name, i)
+		}
+	}
+	return nil
+}
+
+// Instrument is the striker a sequence is played on.
+type Instrument struct {
+	Channel int `json:"channel"`
+	// Rest and Strike are the PWM values at positions 0 and 1.
+	Rest   int `json:"rest"`
+	Strike int `json:"strike"`
+	// Min and Max limit the PWM values set on the instrument's channel. A
+	// zero Max means no limit.
+	Min int `json:"min,omitempty"`
+	Max int `json:"max,omitempty"`
+}
+
+// Validate checks that the instrument's channel, limits and positions are in
+// range.
+func (inst Instrument) Validate() error {
+	switch {
+	case inst.Channel < 0 || inst.Channel > 15:
+		return fmt.Errorf("channel %d out of range", inst.Channel)
+	case inst.Min < 0 || inst.Max < 0 || inst.Max > 4095 || inst.Max != 0 && inst.Min > inst.Max:
+		return fmt.Errorf("bad limits %d-%d", inst.Min, inst.Max)
+	case inst.limit(inst.Rest) != inst.Rest:
+		return fmt.Errorf("rest %d outside limits %d-%d", inst.Rest, inst.Min, inst.Max)
+	case inst.limit(inst.Strike) != inst.Strike:
+		return fmt.Errorf("strike %d outside limits %d-%d", inst.Strike, inst.Min, inst.Max)
+	}
+	return nil
+}
+
+// limit clamps value to the instrument's limits.
+func (inst Instrument) limit(value int) int {
+	max := inst.Max
+	if max == 0 {
+		max = 4095
+	}
+	switch {
+	case value < inst.Min:
+		return inst.Min
+	case value > max:
+		return max
+	}
+	return value
+}
+
+// Controller is the part of pca9685.PCA9685 a sequence drives.
+type Controller interface {
+	Wake() error
+	Sleep() error
+	SetPwm(channel, onTime, offTime int) error
+}
+
+// Player plays sequences on a controller.
+type Player struct {
+	Dev Controller
+	// Freq is the controller's PWM frequency in Hz, used to turn angles into
+	// PWM values.
+	Freq int
+
+	// last holds the last value set on each channel, for easing.
+	last map[int]int
+}
+
+// Play runs seq on inst, returning after the last step's hold. It stops at the
+// first controller error.
+func (p *Player) Play(seq *Sequence, inst Instrument) error {
+	if p.last == nil {
+		p.last = make(map[int]int)
+	}
+	for i, step := range seq.Steps {
+		if err := p.playStep(step, inst); err != nil {
+			return fmt.Errorf("sequence %s step %d: %s", seq.Name, i, err)
+		}
+	}
+	return nil
+}
+
+func (p *Player) playStep(step Step, inst Instrument) error {
+	hold := time.Duration(step.Hold)
+	switch step.Action {
+	case ActionWake:
+		if err := p.Dev.Wake(); err != nil {
+			return fmt.Errorf("waking: %s", err)
+		}
+		time.Sleep(hold)
+		return nil
+	case ActionSleep:
+		if err := p.Dev.Sleep(); err != nil {
+			return fmt.Errorf("sleeping: %s", err)
+		}
+		time.Sleep(hold)
+		return nil
+	}
+
+	channel := inst.Channel
+	if step.Channel != nil {
+		channel = *step.Channel
+	}
+	var target int
+	switch {
+	case step.Position != nil:
+		target = inst.Rest + int(math.Floor(*step.Position*float64(inst.Strike-inst.Rest)+0.5))
+	case step.Angle != nil:
+		target = p.angleToPWM(*step.Angle)
+	case step.PWM != nil:
+		target = *step.PWM
+	}
+	if channel == inst.Channel {
+		target = inst.limit(target)
+	}
+	from, known := p.last[channel]
+	if step.Ease == "" || step.Ease == EaseNone || !known || hold < 2*easeFrame {
+		if err := p.set(channel, target); err != nil {
+			return err
+		}
+		time.Sleep(hold)
+		return nil
+	}
+
+	frames := int(hold / easeFrame)
+	for i := 1; i <= frames; i++ {
+		t := ease(step.Ease, float64(i)/float64(frames))
+		if err := p.set(channel, from+int(math.Floor(t*float64(target-from)+0.5))); err != nil {
+			return err
+		}
+		time.Sleep(easeFrame)
+	}
+	time.Sleep(hold - time.Duration(frames)*easeFrame)
+	return nil
+}
+
+func (p *Player) set(channel, value int) error {
+	if err := p.Dev.SetPwm(channel, 0, value); err != nil {
+		return fmt.Errorf("setting channel %d to %d: %s", channel, value, err)
+	}
+	p.last[channel] = value
+	return nil
+}
+
+// angleToPWM maps angle to the off time of a pulse between 0.5ms and 2.5ms.
+func (p *Player) angleToPWM(angle float64) int {
+	pulse := 500 + angle/180*2000 // microseconds
+	return int(math.Floor(pulse*float64(p.Freq)*4096/1e6 + 0.5))
+}
+
+// ease maps the fraction t of a move's time to the fraction of its distance
+// covered.
+func ease(easing string, t float64) float64 {
+	if easing == EaseInOut {
+		return (1 - math.Cos(math.Pi*t)) / 2
+	}
+	return t
+}
+
+// Roll returns a sequence that plays seq's strike n times back to back. The
+// steps before seq's first set step, such as waking the controller, are
+// played once at the start, and those after its last set step once at the
+// end.
+func Roll(seq *Sequence, n int) *Sequence {
+	if n <= 1 {
+		return seq
+	}
+	first, last := len(seq.Steps), -1
+	for i, step := range seq.Steps {
+		if step.Action == "" || step.Action == ActionSet {
+			if i < first {
+				first = i
+			}
+			last = i
+		}
+	}
+	if last < 0 {
+		return seq
+	}
+	roll := &Sequence{Name: fmt.Sprintf("%s x%d", seq.Name, n)}
+	roll.Steps = append(roll.Steps, seq.Steps[:first]...)
+	for i := 0; i < n; i++ {
+		roll.Steps = append(roll.Steps, seq.Steps[first:last+1]...)
+	}
+	roll.Steps = append(roll.Steps, seq.Steps[last+1:]...)
+	return roll
+}
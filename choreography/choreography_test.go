@@ -0,0 +1,225 @@
+package choreography
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// call is a controller call recorded by recorder.
+type call struct {
+	op    string
+	value int
+	at    time.Time
+}
+
+// recorder is a Controller that records the calls made to it.
+type recorder struct {
+	mu    sync.Mutex
+	calls []call
+}
+
+func (r *recorder) record(op string, value int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call{op: op, value: value, at: time.Now()})
+	return nil
+}
+
+func (r *recorder) Wake() error  { return r.record("wake", 0) }
+func (r *recorder) Sleep() error { return r.record("sleep", 0) }
+
+func (r *recorder) SetPwm(channel, onTime, offTime int) error {
+	return r.record(fmt.Sprintf("set %d", channel), offTime)
+}
+
+// baselineCall is a call the gong made before strikes were described as data,
+// with the delay before the next one.
+type baselineCall struct {
+	op    string
+	value int
+	hold  time.Duration
+}
+
+// slack is how much longer than its hold a step may take.
+const slack = 100 * time.Millisecond
+
+func TestDefaultsMatchBaseline(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		sequence string
+		inst     Instrument
+		want     []baselineCall
+	}{
+		{"bell", Instrument{Channel: 5, Rest: 350, Strike: 650, Min: 350, Max: 650}, []baselineCall{
+			{"wake", 0, 100 * ms},
+			{"set 5", 650, 450 * ms},
+			{"set 5", 350, 400 * ms},
+			{"sleep", 0, 0},
+		}},
+		{"bell", Instrument{Channel: 5, Rest: 600, Strike: 800, Min: 600, Max: 800}, []baselineCall{
+			{"wake", 0, 100 * ms},
+			{"set 5", 800, 450 * ms},
+			{"set 5", 600, 400 * ms},
+			{"sleep", 0, 0},
+		}},
+		{"chime", Instrument{Channel: 6, Rest: 600, Strike: 330, Min: 330, Max: 600}, []baselineCall{
+			{"wake", 0, 100 * ms},
+			{"set 6", 330, 120 * ms},
+			{"set 6", (330 + 2*600) / 3, 500 * ms},
+			{"set 6", 330, 120 * ms},
+			{"set 6", 600, 400 * ms},
+			{"sleep", 0, 0},
+		}},
+		{"chime-new", Instrument{Channel: 6, Rest: 280, Strike: 200, Min: 200, Max: 280}, []baselineCall{
+			{"wake", 0, 100 * ms},
+			{"set 6", 200, 100 * ms},
+			{"set 6", 280, 500 * ms},
+			{"set 6", 200, 100 * ms},
+			{"set 6", 280, 400 * ms},
+			{"sleep", 0, 0},
+		}},
+	}
+
+	var wg sync.WaitGroup
+	for _, tt := range tests {
+		seq, err := Defaults().Get(tt.sequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := &recorder{}
+		wg.Add(1)
+		go func(seq *Sequence, inst Instrument, want []baselineCall) {
+			defer wg.Done()
+			if err := (&Player{Dev: rec, Freq: 100}).Play(seq, inst); err != nil {
+				t.Errorf("%s: %s", seq.Name, err)
+				return
+			}
+			if len(rec.calls) != len(want) {
+				t.Errorf("%s on %+v: %d calls, want %d: %v", seq.Name, inst, len(rec.calls), len(want), rec.calls)
+				return
+			}
+			for i, c := range rec.calls {
+				if c.op != want[i].op || c.value != want[i].value {
+					t.Errorf("%s on %+v: call %d is %s %d, want %s %d", seq.Name, inst, i, c.op, c.value, want[i].op, want[i].value)
+				}
+				if i == 0 {
+					continue
+				}
+				hold := want[i-1].hold
+				if took := c.at.Sub(rec.calls[i-1].at); took < hold || took > hold+slack {
+					t.Errorf("%s on %+v: call %d came %s after the last, want %s", seq.Name, inst, i, took, hold)
+				}
+			}
+		}(seq, tt.inst, tt.want)
+	}
+	wg.Wait()
+}
+
+func TestParse(t *testing.T) {
+	lib, err := Parse([]byte(`{"sequences": {"tap": {"steps": [
+		{"action": "wake"},
+		{"pwm": 0, "channel": 3, "hold": 20},
+		{"angle": 90, "hold": "1s", "ease": "linear"},
+		{"action": "sleep"}
+	]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := lib.Get("tap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq.Name != "tap" || len(seq.Steps) != 4 {
+		t.Fatalf("parsed %+v", seq)
+	}
+	if step := seq.Steps[1]; step.PWM == nil || *step.PWM != 0 || time.Duration(step.Hold) != 20*time.Millisecond {
+		t.Errorf("step 1 = %+v", step)
+	}
+	if step := seq.Steps[2]; time.Duration(step.Hold) != time.Second || step.Ease != EaseLinear {
+		t.Errorf("step 2 = %+v", step)
+	}
+	if _, err := lib.Get("bell"); err == nil {
+		t.Error("Parse included the defaults")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		step string
+		err  string
+	}{
+		{`{"action": "strike"}`, "unknown action"},
+		{`{"position": 1, "ease": "bounce"}`, "unknown easing"},
+		{`{"hold": "100ms"}`, "no position, pwm or angle"},
+		{`{"action": "set", "channel": 2}`, "no position, pwm or angle"},
+		{`{"pwm": 300, "channel": 16}`, "channel 16 out of range"},
+		{`{"position": 1, "channel": 2}`, "position cannot be used with channel"},
+		{`{"position": 1.5}`, "position 1.5 out of range"},
+		{`{"position": -0.5}`, "position -0.5 out of range"},
+		{`{"angle": 181}`, "angle 181 out of range"},
+		{`{"pwm": 4096}`, "pwm 4096 out of range"},
+		{`{"pwm": -1}`, "pwm -1 out of range"},
+		{`{"position": 0, "hold": -5}`, "negative hold"},
+		{`{"action": "wake", "hold": "100ms"}`, ""},
+		{`{"position": 0}`, ""},
+		{`{"pwm": 0, "channel": 0}`, ""},
+		{`{"angle": 0}`, ""},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(`{"sequences": {"s": {"steps": [` + tt.step + `]}}}`))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %s", tt.step, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: no error, want %q", tt.step, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: error %q, want %q", tt.step, err, tt.err)
+		}
+	}
+}
+
+func TestPlayLimitsInstrumentChannel(t *testing.T) {
+	pwm := 4000
+	seq := &Sequence{Name: "s", Steps: []Step{{PWM: &pwm}, {PWM: &pwm, Channel: new(int)}}}
+	rec := &recorder{}
+	if err := (&Player{Dev: rec}).Play(seq, Instrument{Channel: 5, Min: 300, Max: 700}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range rec.calls {
+		got = append(got, fmt.Sprintf("%s %d", c.op, c.value))
+	}
+	if want := []string{"set 5 700", "set 0 4000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func TestRoll(t *testing.T) {
+	bell, err := Defaults().Get("bell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roll := Roll(bell, 3)
+	if roll.Name != "bell x3" {
+		t.Errorf("name = %q", roll.Name)
+	}
+	var actions []string
+	for _, step := range roll.Steps {
+		action := step.Action
+		if action == "" {
+			action = fmt.Sprint(*step.Position)
+		}
+		actions = append(actions, action)
+	}
+	want := []string{"wake", "1", "0", "1", "0", "1", "0", "sleep"}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("roll steps = %v, want %v", actions, want)
+	}
+	if Roll(bell, 1) != bell {
+		t.Error("Roll(seq, 1) is not seq")
+	}
+}
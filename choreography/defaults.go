@@ -0,0 +1,40 @@
+package choreography
+
+// defaultSequences are the strike patterns the gong shipped with. The bell
+// plays the same way on every hardware revision; the new revision's chime has
+// its own pattern.
+const defaultSequences = `{
+  "sequences": {
+    "bell": {"steps": [
+      {"action": "wake", "hold": "100ms"},
+      {"position": 1, "hold": "450ms"},
+      {"position": 0, "hold": "400ms"},
+      {"action": "sleep"}
+    ]},
+    "chime": {"steps": [
+      {"action": "wake", "hold": "100ms"},
+      {"position": 1, "hold": "120ms"},
+      {"position": 0.3333, "hold": "500ms"},
+      {"position": 1, "hold": "120ms"},
+      {"position": 0, "hold": "400ms"},
+      {"action": "sleep"}
+    ]},
+    "chime-new": {"steps": [
+      {"action": "wake", "hold": "100ms"},
+      {"position": 1, "hold": "100ms"},
+      {"position": 0, "hold": "500ms"},
+      {"position": 1, "hold": "100ms"},
+      {"position": 0, "hold": "400ms"},
+      {"action": "sleep"}
+    ]}
+  }
+}`
+
+// Defaults returns a fresh copy of the bundled sequences.
+func Defaults() Library {
+	lib, err := Parse([]byte(defaultSequences))
+	if err != nil {
+		panic("choreography: bad default sequences: " + err.Error())
+	}
+	return lib
+}
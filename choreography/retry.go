@@ -0,0 +1,52 @@
+package choreography
+
+import (
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/jpillora/backoff"
+)
+
+// Retry is a Controller that retries failed calls to Dev, for buses where
+// errors are often transient glitches.
+type Retry struct {
+	Dev Controller
+	// Attempts is how many times each call is tried, at least once.
+	Attempts int
+	// Backoff paces the attempts of each call. Each call starts again from
+	// its Min.
+	Backoff backoff.Backoff
+	// Transient reports whether a call failing with err is worth retrying.
+	// Nil means every error is.
+	Transient func(err error) bool
+	// OnError, if set, is called with every failed attempt.
+	OnError func(err error)
+}
+
+func (r *Retry) Wake() error {
+	return r.do(r.Dev.Wake)
+}
+
+func (r *Retry) Sleep() error {
+	return r.do(r.Dev.Sleep)
+}
+
+func (r *Retry) SetPwm(channel, onTime, offTime int) error {
+	return r.do(func() error { return r.Dev.SetPwm(channel, onTime, offTime) })
+}
+
+func (r *Retry) do(call func() error) error {
+	b := r.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = call(); err == nil {
+			return nil
+		}
+		if r.OnError != nil {
+			r.OnError(err)
+		}
+		if attempt >= r.Attempts || r.Transient != nil && !r.Transient(err) {
+			return err
+		}
+		time.Sleep(b.Duration())
+	}
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/opendoor-labs/gong/choreography"
+	"github.com/opendoor-labs/gong/pca9685sim"
 	"github.com/opendoor-labs/gong/phoenix"
 
 	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/kidoman/embd"
@@ -17,18 +23,29 @@ import (
 	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
+// version identifies the firmware build; set it with -ldflags "-X main.version=...".
+var version = "dev"
+
 const (
-	topicName   = "private:contracts"
-	servoMin    = 350
-	servoMax    = 650
-	servoMinNew = 600
-	servoMaxNew = 800
+	topicName = "private:contracts"
+	// systemTestEvent asks a gong to ring its instruments. It is handled
+	// apart from the routing table, which may not route it.
+	systemTestEvent = "system_test"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sim" {
+		runSim(os.Args[2:])
+		return
+	}
+
+	simulate := flag.Bool("simulate", false, "drive a simulated servo controller instead of the one on the I2C bus")
+	flag.Parse()
+
 	guardianToken := os.Getenv("GUARDIAN_TOKEN")
-	if guardianToken == "" {
-		log.Fatal("GUARDIAN_TOKEN is required")
+	tokenFile := os.Getenv("GUARDIAN_TOKEN_FILE")
+	if guardianToken == "" && tokenFile == "" {
+		log.Fatal("GUARDIAN_TOKEN or GUARDIAN_TOKEN_FILE is required")
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -36,63 +53,119 @@ func main() {
 	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
 	go handleSignals(sigch, ctx, cancel)
 
-	if err := embd.InitI2C(); err != nil {
-		log.Fatal("I2C init: ", err)
+	sequences, hw, err := loadConfig(os.Getenv("HARDWARE_PROFILE"))
+	if err != nil {
+		log.Fatal(err)
 	}
-	defer embd.CloseI2C()
+	log.Printf("using hardware profile %s", hw.Name)
 
-	bus := embd.NewI2CBus(1)
+	var bus embd.I2CBus
+	if *simulate {
+		sim := pca9685sim.New(hw.Address)
+		sim.OnChange = func(s pca9685sim.Sample) {
+			log.Printf("simulated channel %d: pulse width %s", s.Channel, s.Width)
+		}
+		bus = sim.I2CBus()
+	} else {
+		if err := embd.InitI2C(); err != nil {
+			log.Fatal("I2C init: ", err)
+		}
+		defer embd.CloseI2C()
+		bus = embd.NewI2CBus(hw.Bus)
+	}
 
-	dev := pca9685.New(bus, 0x40)
-	dev.Freq = 100
+	dev := pca9685.New(bus, hw.Address)
+	dev.Freq = hw.Frequency
 	defer dev.Close()
 
-	// wake the servo controller so we can reset its channels
+	// wake the servo controller so we can reset its channels. Failures are
+	// logged and startup goes on, as they are when ringing, since each
+	// sequence wakes the controller again.
 	if err := dev.Wake(); err != nil {
-		log.Fatal("waking: ", err)
+		log.Print("waking: ", err)
+	}
+	if err := resetAllChannels(dev, hw); err != nil {
+		log.Print("resetting channels: ", err)
 	}
-	resetAllChannels(dev)
 	resetTimer := time.After(time.Second) // long enough for servos to reset
 
-	query := url.Values{}
-	query.Set("vsn", "1.0.0")
-	query.Set("guardian_token", guardianToken)
+	// The guardian token is added to the URL and join payloads by
+	// guardianCredentials.
 	u := url.URL{
-		Scheme:   "wss",
-		Host:     "opendoor-pusher.herokuapp.com",
-		Path:     "/events/websocket",
-		RawQuery: query.Encode(),
+		Scheme: "wss",
+		Host:   "opendoor-pusher.herokuapp.com",
+		Path:   "/events/websocket",
 	}
 
-	joinPayload, err := json.Marshal(GuardianPayload{GuardianToken: guardianToken})
-	if err != nil {
-		log.Fatal(err)
+	logLevel := phoenix.LevelInfo
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		var err error
+		if logLevel, err = phoenix.ParseLevel(level); err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts := []phoenix.Option{
+		phoenix.WithLogger(phoenix.NewStdLogger(log.New(os.Stderr, "phoenix: ", log.LstdFlags), logLevel)),
+		phoenix.WithCredentials(guardianCredentials(guardianToken, tokenFile)),
+	}
+	if proxy := os.Getenv("HTTPS_PROXY"); proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			log.Fatal("parsing HTTPS_PROXY: ", err)
+		}
+		opts = append(opts, phoenix.WithProxy(proxyURL))
+	}
+	if os.Getenv("PHOENIX_COMPRESS") != "" {
+		opts = append(opts, phoenix.WithCompression())
+	}
+	if os.Getenv("LONGPOLL_FALLBACK") != "" {
+		opts = append(opts, phoenix.WithLongPollFallback(3))
+	}
+	if field := os.Getenv("REPLAY_CURSOR_FIELD"); field != "" {
+		cursorFile := os.Getenv("REPLAY_CURSOR_FILE")
+		if cursorFile == "" {
+			cursorFile = "/data/replay-cursors.json"
+		}
+		opts = append(opts, phoenix.WithReplay(phoenix.ReplayConfig{
+			Cursor:    phoenix.PayloadField(field),
+			JoinParam: "last_seen",
+			Store:     phoenix.FileCursorStore{Path: cursorFile},
+		}))
 	}
 
-	client := phoenix.InitClient(u.String(), []string{topicName}, joinPayload)
-	eventch := client.Start()
-	defer client.Close()
+	client := phoenix.InitClient(u.String(), []string{topicName}, nil, opts...)
+	eventch := client.Events()
 
 	select {
 	case <-resetTimer: // servos have had enough time to reset
 		if err := dev.Sleep(); err != nil {
-			log.Fatal(err)
+			log.Print("sleeping: ", err)
 		}
 	case <-ctx.Done():
 		return
 	}
 
+	r := newRinger(ctx, dev, dev.Freq, hw, sequences)
+	defer func() {
+		cancel()
+		r.Wait()
+	}()
+	rt, clientDone, err := connect(ctx, client, r, os.Getenv("ROUTES_FILE"), os.Getenv("PRESENCE_TOPIC"))
+	if err != nil {
+		log.Fatal("loading routes: ", err)
+	}
+	defer func() {
+		cancel()
+		<-clientDone
+	}()
+	reloadch := make(chan os.Signal, 1)
+	signal.Notify(reloadch, syscall.SIGHUP)
+	go reloadOnSignal(ctx, reloadch, rt)
+
 	for {
 		select {
 		case evt := <-eventch:
-			switch evt.Event {
-			case "acquisition_contract", "resale_contract":
-				handleRingEvent(dev, evt)
-			case "system_test":
-				handleSystemTest(dev, evt)
-			default:
-				log.Printf("unhandled message received: %#v", evt)
-			}
+			log.Printf("unhandled message received: topic=%q event=%q ref=%q", evt.Topic, evt.Event, evt.Ref)
 		case <-ctx.Done():
 			return
 		}
@@ -113,197 +186,233 @@ func handleSignals(sigch <-chan os.Signal, ctx context.Context, cancel context.C
 	}
 }
 
-type AddressPayload struct {
-	Address string
-}
-
-type GuardianPayload struct {
-	GuardianToken string `json:"guardian_token"`
+// loadConfig loads the strike sequences and the hardware profile called
+// profileName, or else the one for this device.
+func loadConfig(profileName string) (choreography.Library, *profile, error) {
+	sequences, err := loadSequences(os.Getenv("CHOREOGRAPHY_FILE"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading choreography: %s", err)
+	}
+	profiles, err := loadProfiles(os.Getenv("HARDWARE_PROFILES_FILE"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading hardware profiles: %s", err)
+	}
+	hw, err := profiles.selectProfile(profileName, os.Getenv("RESIN_DEVICE_UUID"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := hw.checkSequences(sequences); err != nil {
+		return nil, nil, err
+	}
+	return sequences, hw, nil
 }
 
-func resetAllChannels(d *pca9685.PCA9685) error {
-	for i := 0; i < 16; i++ {
-		setting := servoMin
-		if i == bellChannels["resale_contract"] {
-			if isNewHardware() {
-				setting = chimeMaxNew
-			} else {
-				setting = chimeMax
-			}
-		} else if isNewHardware() {
-			setting = servoMinNew
-		}
-		if err := d.SetPwm(i, 0, setting); err != nil {
-			return err
-		}
+// connect registers the handlers for events on the contracts topic, and for
+// presence on presenceTopic if it is set, then runs client until ctx is done.
+// The handlers come first so events the server replays right after the join
+// are rung rather than left unhandled. done is closed once the client stops.
+func connect(ctx context.Context, client *phoenix.Client, r *ringer, routesFile, presenceTopic string) (rt *router, done <-chan struct{}, err error) {
+	rt, err = listen(ctx, client.Channel(topicName), r, routesFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if presenceTopic != "" {
+		trackPresence(ctx, client, presenceTopic, r.hw.Name)
 	}
-	return nil
-}
 
-var bellChannels = map[string]int{
-	"acquisition_contract": 5,
-	"resale_contract":      6,
+	clientDone := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(clientDone)
+	}()
+	return rt, clientDone, nil
 }
 
-func handleRingEvent(dev *pca9685.PCA9685, evt *phoenix.Event) {
-	payload := AddressPayload{}
-	if err := json.Unmarshal(evt.Payload, &payload); err != nil {
-		log.Printf("unmarshaling %s payload: %s", evt.Event, err)
-		return
+// listen loads the routing table in routesFile and registers the handlers
+// that ring r's instruments for events on contracts.
+func listen(ctx context.Context, contracts *phoenix.Channel, r *ringer, routesFile string) (*router, error) {
+	rt := &router{
+		path:      routesFile,
+		sequences: r.sequences,
+		hw:        r.hw,
+		ch:        contracts,
+	}
+	rt.handler = func(evt *phoenix.Event) {
+		if handleRingEvent(r, rt, evt) && os.Getenv("SEND_RANG_ACKS") != "" {
+			go ackRing(ctx, contracts, evt)
+		}
 	}
-	log.Printf("%s received: topic=%q ref=%q payload=%#v", evt.Event, evt.Topic, evt.Ref, payload)
-	switch evt.Event {
-	case "acquisition_contract":
-		ringBell(dev, bellChannels[evt.Event])
-	case "resale_contract":
-		ringChime(dev, bellChannels[evt.Event])
+	if err := rt.Reload(); err != nil {
+		return nil, err
 	}
+	contracts.On(systemTestEvent, func(evt *phoenix.Event) { handleSystemTest(r, evt) })
+	return rt, nil
 }
 
-func handleSystemTest(dev *pca9685.PCA9685, evt *phoenix.Event) {
-	payload := struct {
-		DeviceID      string `json:"device_id"`
-		SubsystemName string `json:"subsystem_name"`
-	}{}
-	if err := json.Unmarshal(evt.Payload, &payload); err != nil {
-		log.Printf("unmarshaling %s payload: %s", evt.Event, err)
-		return
-	}
-
-	if payload.DeviceID == "" || payload.DeviceID != os.Getenv("RESIN_DEVICE_UUID") {
-		log.Printf("system test requested for device_id=%s, skipped with device_id=%d", payload.DeviceID, os.Getenv("RESIN_DEVICE_UUID"))
-		return
-	}
-	switch payload.SubsystemName {
-	case "bell":
-		log.Printf("running system test with bell...")
-		ringBell(dev, bellChannels["acquisition_contract"])
-	case "chime":
-		log.Printf("running system test with chime...")
-		ringChime(dev, bellChannels["resale_contract"])
-	default:
-		log.Printf("running system test with both bell and chime...")
-		ringBell(dev, bellChannels["acquisition_contract"])
-		time.Sleep(time.Second)
-		ringChime(dev, bellChannels["resale_contract"])
+// reloadOnSignal reloads the routing table each time a signal arrives on sigch.
+func reloadOnSignal(ctx context.Context, sigch <-chan os.Signal, rt *router) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigch:
+			if err := rt.Reload(); err != nil {
+				log.Printf("reloading routes, keeping the current ones: %s", err)
+			}
+		}
 	}
 }
 
-func ringBell(d *pca9685.PCA9685, chanID int) {
-	if isNewHardware() {
-		ringBellNew(d, chanID)
-		return
+// guardianCredentials supplies the guardian token for the socket URL and join
+// payloads. If tokenFile is set the token is read from it, and read again
+// whenever the server rejects it, so it can be rotated without a redeploy;
+// token is used until the file can be read.
+func guardianCredentials(token, tokenFile string) phoenix.CredentialsFunc {
+	loaded := false
+	return func(refresh bool) (phoenix.Credentials, error) {
+		if tokenFile != "" && (refresh || !loaded) {
+			data, err := ioutil.ReadFile(tokenFile)
+			switch {
+			case err == nil:
+				token = strings.TrimSpace(string(data))
+				loaded = true
+			case token == "":
+				return phoenix.Credentials{}, err
+			default:
+				log.Printf("reading %s, keeping the current token: %s", tokenFile, err)
+			}
+		}
+		return phoenix.Credentials{
+			Params:     url.Values{"guardian_token": {token}},
+			JoinParams: map[string]interface{}{"guardian_token": token},
+		}, nil
 	}
+}
 
-	if err := d.Wake(); err != nil {
-		log.Fatal("waking: ", err)
-	}
-	time.Sleep(100 * time.Millisecond)
-	if err := d.SetPwm(chanID, 0, servoMax); err != nil {
-		log.Fatal("setting to max: ", err)
-	}
-	time.Sleep(450 * time.Millisecond)
+// trackPresence joins topic, logs other gongs coming and going, and
+// announces this device and its hardware profile on it.
+func trackPresence(ctx context.Context, client *phoenix.Client, topic, hardware string) {
+	ch := client.Channel(topic)
+	presence := ch.Presence()
+	presence.OnJoin(func(key string, current, joined []phoenix.Meta) {
+		if len(current) == 0 {
+			log.Printf("gong online: %s %v", key, joined)
+		}
+	})
+	presence.OnLeave(func(key string, current, left []phoenix.Meta) {
+		if len(current) == 0 {
+			log.Printf("gong offline: %s", key)
+		}
+	})
+	ch.Join(nil)
 
-	if err := d.SetPwm(chanID, 0, servoMin); err != nil {
-		log.Fatal("setting to min: ", err)
+	meta := map[string]string{
+		"device_id": os.Getenv("RESIN_DEVICE_UUID"),
+		"hardware":  hardware,
+		"firmware":  version,
 	}
-	time.Sleep(400 * time.Millisecond)
-	if err := d.Sleep(); err != nil {
-		log.Fatal("sleeping: ", err)
+	if err := presence.Track(ctx, meta); err != nil {
+		log.Printf("tracking presence on %s: %s", topic, err)
 	}
 }
 
-func ringBellNew(d *pca9685.PCA9685, chanID int) {
-	if err := d.Wake(); err != nil {
-		log.Fatal("waking: ", err)
+// resetAllChannels moves every instrument to rest, and every other channel to
+// the profile's idle value if it has one.
+func resetAllChannels(d *pca9685.PCA9685, hw *profile) error {
+	rest := make(map[int]int)
+	for _, inst := range hw.Instruments {
+		rest[inst.Channel] = inst.Rest
 	}
-	time.Sleep(100 * time.Millisecond)
-	if err := d.SetPwm(chanID, 0, servoMaxNew); err != nil {
-		log.Fatal("setting to max: ", err)
+	for i := 0; i < 16; i++ {
+		setting, ok := rest[i]
+		if !ok {
+			if hw.Idle == nil {
+				continue
+			}
+			setting = *hw.Idle
+		}
+		if err := d.SetPwm(i, 0, setting); err != nil {
+			return err
+		}
 	}
-	time.Sleep(450 * time.Millisecond)
+	return nil
+}
 
-	if err := d.SetPwm(chanID, 0, servoMinNew); err != nil {
-		log.Fatal("setting to min: ", err)
-	}
-	time.Sleep(400 * time.Millisecond)
-	if err := d.Sleep(); err != nil {
-		log.Fatal("sleeping: ", err)
+// handleRingEvent queues the strikes the routing table gives for evt. It
+// reports whether anything was queued.
+func handleRingEvent(r *ringer, rt *router, evt *phoenix.Event) bool {
+	strikes, err := rt.Route(evt)
+	if err != nil {
+		log.Printf("unmarshaling %s payload: %s", evt.Event, err)
+		return false
+	}
+	if len(strikes) == 0 {
+		log.Printf("%s received: topic=%q ref=%q, no route matched", evt.Event, evt.Topic, evt.Ref)
+		return false
+	}
+	log.Printf("%s received: topic=%q ref=%q, ringing %v", evt.Event, evt.Topic, evt.Ref, strikes)
+	queued := false
+	for _, s := range strikes {
+		if err := r.Strike(s.Instrument, s.Sequence); err != nil {
+			log.Print(err)
+			continue
+		}
+		queued = true
 	}
+	return queued
 }
 
-const (
-	chimeMax    = 600
-	chimeMin    = 330
-	chimeMaxNew = 280
-	chimeMinNew = 200
-)
-
-func ringChime(d *pca9685.PCA9685, chanID int) {
-	if isNewHardware() {
-		ringChimeNew(d, chanID)
+// ackRing tells the server that evt rang this device. The push is queued
+// through disconnects until the server acknowledges it.
+func ackRing(ctx context.Context, ch *phoenix.Channel, evt *phoenix.Event) {
+	payload, err := json.Marshal(struct {
+		DeviceID string          `json:"device_id"`
+		Event    string          `json:"event"`
+		Payload  json.RawMessage `json:"payload"`
+	}{os.Getenv("RESIN_DEVICE_UUID"), evt.Event, evt.Payload})
+	if err != nil {
+		log.Printf("marshaling rang ack: %s", err)
 		return
 	}
-
-	if err := d.Wake(); err != nil {
-		log.Fatal("waking: ", err)
-	}
-	time.Sleep(100 * time.Millisecond)
-	if err := d.SetPwm(chanID, 0, chimeMin); err != nil {
-		log.Fatal("setting to min: ", err)
-	}
-	time.Sleep(120 * time.Millisecond)
-
-	if err := d.SetPwm(chanID, 0, (chimeMin+2*chimeMax)/3); err != nil {
-		log.Fatal("setting to middle: ", err)
-	}
-	time.Sleep(500 * time.Millisecond)
-
-	if err := d.SetPwm(chanID, 0, chimeMin); err != nil {
-		log.Fatal("setting to min 2: ", err)
-	}
-	time.Sleep(120 * time.Millisecond)
-
-	if err := d.SetPwm(chanID, 0, chimeMax); err != nil {
-		log.Fatal("setting to max: ", err)
+	reply, err := ch.Push(ctx, "rang", payload)
+	if err != nil {
+		log.Printf("sending rang ack for %s: %s", evt.Event, err)
+		return
 	}
-	time.Sleep(400 * time.Millisecond)
-
-	if err := d.Sleep(); err != nil {
-		log.Fatal("sleeping: ", err)
+	if !reply.OK() {
+		log.Printf("rang ack for %s rejected: %s", evt.Event, reply.Status)
 	}
 }
 
-func ringChimeNew(d *pca9685.PCA9685, chanID int) {
-	if err := d.Wake(); err != nil {
-		log.Fatal("waking: ", err)
-	}
-	time.Sleep(100 * time.Millisecond)
-	if err := d.SetPwm(chanID, 0, chimeMinNew); err != nil {
-		log.Fatal("setting to min: ", err)
-	}
-	time.Sleep(100 * time.Millisecond)
-
-	if err := d.SetPwm(chanID, 0, chimeMaxNew); err != nil {
-		log.Fatal("setting to middle: ", err)
+func handleSystemTest(r *ringer, evt *phoenix.Event) {
+	payload := struct {
+		DeviceID      string `json:"device_id"`
+		SubsystemName string `json:"subsystem_name"`
+	}{}
+	if err := json.Unmarshal(evt.Payload, &payload); err != nil {
+		log.Printf("unmarshaling %s payload: %s", evt.Event, err)
+		return
 	}
-	time.Sleep(500 * time.Millisecond)
 
-	if err := d.SetPwm(chanID, 0, chimeMinNew); err != nil {
-		log.Fatal("setting to min 2: ", err)
+	if payload.DeviceID == "" || payload.DeviceID != os.Getenv("RESIN_DEVICE_UUID") {
+		log.Printf("system test requested for device_id=%s, skipped with device_id=%s", payload.DeviceID, os.Getenv("RESIN_DEVICE_UUID"))
+		return
 	}
-	time.Sleep(100 * time.Millisecond)
-
-	if err := d.SetPwm(chanID, 0, chimeMaxNew); err != nil {
-		log.Fatal("setting to max: ", err)
+	if _, ok := r.hw.Instruments[payload.SubsystemName]; ok {
+		log.Printf("running system test with %s...", payload.SubsystemName)
+		if err := r.Strike(payload.SubsystemName, ""); err != nil {
+			log.Print(err)
+		}
+		return
 	}
-	time.Sleep(400 * time.Millisecond)
-
-	if err := d.Sleep(); err != nil {
-		log.Fatal("sleeping: ", err)
+	// ring the instruments one after another so each can be heard
+	names := r.hw.instrumentNames()
+	log.Printf("running system test with %s...", strings.Join(names, " and "))
+	for i, name := range names {
+		r.StrikeAfter(time.Duration(i)*systemTestInterval, name, "")
 	}
 }
 
-func isNewHardware() bool {
-	return os.Getenv("NEW_HARDWARE") != ""
-}
+// systemTestInterval separates the instruments in a system test of all of
+// them.
+const systemTestInterval = 2 * time.Second
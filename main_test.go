@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// cursorStore is a phoenix.CursorStore that starts with a cursor for the
+// contracts topic.
+type cursorStore struct{}
+
+func (cursorStore) Load() (map[string]string, error) {
+	return map[string]string{topicName: "5"}, nil
+}
+
+func (cursorStore) Save(map[string]string) error { return nil }
+
+func TestConnectRingsEventsReplayedOnJoin(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	r, bus := simRinger(t, ctx)
+	client := phoenix.InitClient(s.URL, []string{topicName}, nil,
+		phoenix.WithReplay(phoenix.ReplayConfig{
+			Cursor:    phoenix.PayloadField("id"),
+			JoinParam: "last_seen",
+			Store:     cursorStore{},
+		}))
+
+	// the server replays what was missed as soon as the topic is joined
+	replayed := make(chan error, 1)
+	go func() {
+		join, err := s.WaitForEvent(topicName, "phx_join", 5*time.Second)
+		if err != nil {
+			replayed <- err
+			return
+		}
+		if string(join.Payload) != `{"last_seen":"5"}` {
+			t.Errorf("join payload = %s", join.Payload)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for n := 0; n == 0 && time.Now().Before(deadline); {
+			n, err = s.Broadcast(topicName, "resale_contract", map[string]string{"id": "6"})
+		}
+		replayed <- err
+	}()
+
+	_, done, err := connect(ctx, client, r, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		<-done
+		r.Wait()
+	}()
+	if err := <-replayed; err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if n, _ := strikes(bus, 6, 330); n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replayed event did not ring the chime")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case evt := <-client.Events():
+		t.Errorf("replayed %s left unhandled", evt.Event)
+	default:
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !sim
+// +build !sim
+
+package main
+
+import "log"
+
+// runSim stands in for the sim command, which is only built with the sim
+// tag.
+func runSim(args []string) {
+	log.Fatal("gong sim is not built in; build gong with -tags sim")
+}
@@ -0,0 +1,297 @@
+// Package pca9685sim simulates a PCA9685 PWM controller on an I2C bus, for
+// running the gong without one.
+//
+// Bus models the registers the pca9685 driver uses: MODE1's sleep, restart and
+// auto-increment bits, the prescaler and the LEDn_ON/LEDn_OFF registers of the
+// 16 channels. It records the pulse width each channel outputs over time.
+package pca9685sim
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/kidoman/embd"
+)
+
+// Registers and bits, from the PCA9685 datasheet.
+const (
+	regMode1    = 0x00
+	regLED0OnL  = 0x06
+	regPrescale = 0xFE
+
+	mode1Restart = 0x80
+	mode1AI      = 0x20
+	mode1Sleep   = 0x10
+
+	// fullBit in LEDn_ON_H or LEDn_OFF_H turns the channel fully on or off.
+	fullBit = 0x10
+
+	oscillatorFreq = 25000000
+	// Channels is the number of PWM channels.
+	Channels = 16
+)
+
+// Sample is a change of a channel's output.
+type Sample struct {
+	// At is when the change happened, since the first transfer on the bus.
+	At      time.Duration
+	Channel int
+	// Width is the channel's pulse width, zero if it is off.
+	Width time.Duration
+}
+
+// Bus is an I2C bus with a simulated PCA9685 at one address. Use I2CBus to
+// drive it with the pca9685 driver. It is safe for concurrent use.
+type Bus struct {
+	// Addr is the controller's address; transfers to others fail.
+	Addr byte
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+	// OnChange, if set, is called with every sample as it is recorded.
+	OnChange func(Sample)
+
+	mu    sync.Mutex
+	start time.Time
+	regs  [256]byte
+	// ptr is the register pointer, which register-less reads start at.
+	ptr byte
+	// halted is set when the controller is put to sleep with outputs active,
+	// which stay off until restarted.
+	halted   bool
+	widths   [Channels]time.Duration
+	timeline []Sample
+}
+
+// New returns a bus with a controller at addr in its power-on state.
+func New(addr byte) *Bus {
+	b := &Bus{Addr: addr}
+	b.regs[regMode1] = mode1Sleep | 0x01 // ALLCALL
+	b.regs[regPrescale] = 0x1E
+	for ch := 0; ch < Channels; ch++ {
+		b.regs[regLED0OnL+4*ch+3] = fullBit
+	}
+	return b
+}
+
+func (b *Bus) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+// Timeline returns the samples recorded so far, in order.
+func (b *Bus) Timeline() []Sample {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Sample(nil), b.timeline...)
+}
+
+// Width returns the pulse width channel is outputting.
+func (b *Bus) Width(channel int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.widths[channel]
+}
+
+// Frequency returns the PWM frequency the prescaler is set to, in Hz.
+func (b *Bus) Frequency() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return float64(oscillatorFreq) / (4096 * (float64(b.regs[regPrescale]) + 1))
+}
+
+func (b *Bus) check(addr byte) error {
+	if addr != b.Addr {
+		return fmt.Errorf("pca9685sim: no device at address %#02x", addr)
+	}
+	return nil
+}
+
+// ErrUnsupported is returned by the transfers the simulated bus does not
+// model.
+var ErrUnsupported = errors.New("pca9685sim: transfer not supported, use ReadCurrent or SetPointer")
+
+// I2CBus returns b as an embd.I2CBus. The pca9685 driver only makes register
+// transfers; the interface's bare ReadByte and WriteByte, whose names go vet
+// reserves for io.ByteReader and io.ByteWriter, fail with ErrUnsupported. Use
+// ReadCurrent and SetPointer instead.
+func (b *Bus) I2CBus() embd.I2CBus {
+	return i2cBus{b}
+}
+
+// i2cBus completes Bus as an embd.I2CBus. go vet's stdmethods check flags its
+// ReadByte and WriteByte, but embd.I2CBus fixes their signatures; keeping them
+// here keeps Bus's own methods clean.
+type i2cBus struct {
+	*Bus
+}
+
+func (i2cBus) ReadByte(addr byte) (byte, error) {
+	return 0, ErrUnsupported
+}
+
+func (i2cBus) WriteByte(addr, value byte) error {
+	return ErrUnsupported
+}
+
+// ReadCurrent reads the register the pointer is at, as a read without a
+// register address does.
+func (b *Bus) ReadCurrent(addr byte) (byte, error) {
+	b.mu.Lock()
+	reg := b.ptr
+	b.mu.Unlock()
+	return b.ReadByteFromReg(addr, reg)
+}
+
+// SetPointer sets the register pointer, as a write of just a register
+// address does.
+func (b *Bus) SetPointer(addr, reg byte) error {
+	if err := b.check(addr); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ptr = reg
+	return nil
+}
+
+func (b *Bus) WriteBytes(addr byte, value []byte) error {
+	if len(value) == 0 {
+		return b.check(addr)
+	}
+	if len(value) == 1 {
+		return b.SetPointer(addr, value[0])
+	}
+	return b.WriteToReg(addr, value[0], value[1:])
+}
+
+func (b *Bus) ReadFromReg(addr, reg byte, value []byte) error {
+	if err := b.check(addr); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range value {
+		value[i] = b.regs[reg]
+		if b.regs[regMode1]&mode1AI != 0 {
+			reg++
+		}
+	}
+	b.ptr = reg
+	return nil
+}
+
+func (b *Bus) ReadByteFromReg(addr, reg byte) (byte, error) {
+	buf := make([]byte, 1)
+	err := b.ReadFromReg(addr, reg, buf)
+	return buf[0], err
+}
+
+func (b *Bus) ReadWordFromReg(addr, reg byte) (uint16, error) {
+	buf := make([]byte, 2)
+	err := b.ReadFromReg(addr, reg, buf)
+	return uint16(buf[0])<<8 | uint16(buf[1]), err
+}
+
+func (b *Bus) WriteToReg(addr, reg byte, value []byte) error {
+	if err := b.check(addr); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, v := range value {
+		b.write(reg, v)
+		if b.regs[regMode1]&mode1AI != 0 {
+			reg++
+		}
+	}
+	b.ptr = reg
+	// outputs change at the end of the transfer
+	b.update()
+	return nil
+}
+
+func (b *Bus) WriteByteToReg(addr, reg, value byte) error {
+	return b.WriteToReg(addr, reg, []byte{value})
+}
+
+func (b *Bus) WriteWordToReg(addr, reg byte, value uint16) error {
+	return b.WriteToReg(addr, reg, []byte{byte(value >> 8), byte(value)})
+}
+
+func (b *Bus) Close() error {
+	return nil
+}
+
+// write sets a register as the controller would.
+func (b *Bus) write(reg, v byte) {
+	switch reg {
+	case regMode1:
+		old := b.regs[regMode1]
+		asleep := old&mode1Sleep != 0
+		restart := old & mode1Restart
+		switch {
+		case !asleep && v&mode1Sleep != 0:
+			// going to sleep turns the outputs off until they are
+			// restarted
+			b.halted = true
+			restart = mode1Restart
+		case v&mode1Sleep == 0 && v&mode1Restart != 0:
+			// writing 1 to RESTART while awake clears it and restarts
+			b.halted = false
+			restart = 0
+		}
+		b.regs[regMode1] = v&^mode1Restart | restart
+	case regPrescale:
+		// the prescaler can only be set while asleep
+		if b.regs[regMode1]&mode1Sleep != 0 {
+			b.regs[regPrescale] = v
+		}
+	default:
+		b.regs[reg] = v
+	}
+}
+
+// update records the channels whose output changed.
+func (b *Bus) update() {
+	running := b.regs[regMode1]&mode1Sleep == 0 && !b.halted
+	// one count of the PWM period, in nanoseconds
+	count := (float64(b.regs[regPrescale]) + 1) * 1e9 / oscillatorFreq
+	now := b.now()
+	if b.start.IsZero() {
+		b.start = now
+	}
+	at := now.Sub(b.start)
+	for ch := 0; ch < Channels; ch++ {
+		var width time.Duration
+		if running {
+			width = time.Duration(float64(b.counts(ch)) * count)
+		}
+		if width == b.widths[ch] {
+			continue
+		}
+		b.widths[ch] = width
+		s := Sample{At: at, Channel: ch, Width: width}
+		b.timeline = append(b.timeline, s)
+		if b.OnChange != nil {
+			b.OnChange(s)
+		}
+	}
+}
+
+// counts returns how many of the 4096 counts of each period channel is high.
+func (b *Bus) counts(ch int) int {
+	r := b.regs[regLED0OnL+4*ch : regLED0OnL+4*ch+4]
+	switch {
+	case r[3]&fullBit != 0:
+		return 0
+	case r[1]&fullBit != 0:
+		return 4096
+	}
+	on := int(r[1]&0x0F)<<8 | int(r[0])
+	off := int(r[3]&0x0F)<<8 | int(r[2])
+	return (off - on + 4096) % 4096
+}
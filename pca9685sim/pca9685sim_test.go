@@ -0,0 +1,160 @@
+package pca9685sim_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/kidoman/embd/controller/pca9685"
+	"github.com/opendoor-labs/gong/choreography"
+	"github.com/opendoor-labs/gong/pca9685sim"
+)
+
+const addr = 0x40
+
+// step is an expected change of a channel's output, in counts of the PWM
+// period, after when since the first.
+type step struct {
+	after  time.Duration
+	counts int
+}
+
+// slack is how late a change may come after its expected time.
+const slack = 150 * time.Millisecond
+
+// settle is how long a channel's output may take to settle. The driver sets
+// a channel's four registers in separate transfers, so the output passes
+// through intermediate widths in between, as the real controller's does.
+const settle = 5 * time.Millisecond
+
+func play(t *testing.T, name string, inst choreography.Instrument) *pca9685sim.Bus {
+	bus := pca9685sim.New(addr)
+	dev := pca9685.New(bus.I2CBus(), addr)
+	dev.Freq = 100
+	seq, err := choreography.Defaults().Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &choreography.Player{Dev: dev, Freq: dev.Freq}
+	if err := p.Play(seq, inst); err != nil {
+		t.Fatal(err)
+	}
+	return bus
+}
+
+// checkTimeline compares the output of channel on bus with want.
+func checkTimeline(t *testing.T, bus *pca9685sim.Bus, channel int, want []step) {
+	perCount := 1 / (bus.Frequency() * 4096)
+	var got []pca9685sim.Sample
+	for _, s := range bus.Timeline() {
+		switch {
+		case s.Channel != channel:
+			if s.Width != 0 {
+				t.Errorf("channel %d set to %s", s.Channel, s.Width)
+			}
+		case len(got) > 0 && s.At-got[len(got)-1].At < settle:
+			got[len(got)-1].Width = s.Width
+		default:
+			got = append(got, s)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("channel %d changed %d times, want %d: %v", channel, len(got), len(want), got)
+	}
+	for i, s := range got {
+		counts := int(math.Floor(s.Width.Seconds()/perCount + 0.5))
+		if counts != want[i].counts {
+			t.Errorf("change %d: %d counts (%s), want %d", i, counts, s.Width, want[i].counts)
+		}
+		after := s.At - got[0].At
+		if after < want[i].after || after > want[i].after+slack {
+			t.Errorf("change %d after %s, want %s", i, after, want[i].after)
+		}
+	}
+}
+
+func TestFrequency(t *testing.T) {
+	bus := play(t, "bell", choreography.Instrument{Channel: 5, Rest: 350, Strike: 650})
+	if f := bus.Frequency(); math.Abs(f-100) > 0.5 {
+		t.Errorf("frequency = %.2f Hz, want 100", f)
+	}
+}
+
+func TestBell(t *testing.T) {
+	bus := play(t, "bell", choreography.Instrument{Channel: 5, Rest: 350, Strike: 650, Min: 350, Max: 650})
+	checkTimeline(t, bus, 5, []step{
+		{0, 650},
+		{450 * time.Millisecond, 350},
+		{850 * time.Millisecond, 0},
+	})
+}
+
+func TestChime(t *testing.T) {
+	bus := play(t, "chime", choreography.Instrument{Channel: 6, Rest: 600, Strike: 330, Min: 330, Max: 600})
+	checkTimeline(t, bus, 6, []step{
+		{0, 330},
+		{120 * time.Millisecond, 510},
+		{620 * time.Millisecond, 330},
+		{740 * time.Millisecond, 600},
+		{1140 * time.Millisecond, 0},
+	})
+}
+
+func TestChimeNew(t *testing.T) {
+	bus := play(t, "chime-new", choreography.Instrument{Channel: 6, Rest: 280, Strike: 200, Min: 200, Max: 280})
+	checkTimeline(t, bus, 6, []step{
+		{0, 200},
+		{100 * time.Millisecond, 280},
+		{600 * time.Millisecond, 200},
+		{700 * time.Millisecond, 280},
+		{1100 * time.Millisecond, 0},
+	})
+}
+
+func TestSleepHaltsOutputs(t *testing.T) {
+	bus := pca9685sim.New(addr)
+	dev := pca9685.New(bus.I2CBus(), addr)
+	dev.Freq = 100
+	// the driver leaves the controller asleep, as it powers up
+	if err := dev.SetPwm(3, 0, 400); err != nil {
+		t.Fatal(err)
+	}
+	if w := bus.Width(3); w != 0 {
+		t.Fatalf("channel 3 outputs %s before Wake", w)
+	}
+	if err := dev.Wake(); err != nil {
+		t.Fatal(err)
+	}
+	if bus.Width(3) == 0 {
+		t.Fatal("channel 3 not running after Wake")
+	}
+	if err := dev.Sleep(); err != nil {
+		t.Fatal(err)
+	}
+	if w := bus.Width(3); w != 0 {
+		t.Errorf("channel 3 outputs %s while asleep", w)
+	}
+	if err := dev.Wake(); err != nil {
+		t.Fatal(err)
+	}
+	if bus.Width(3) == 0 {
+		t.Error("channel 3 not restarted by Wake")
+	}
+}
+
+func TestWrongAddress(t *testing.T) {
+	bus := pca9685sim.New(addr)
+	if err := bus.WriteByteToReg(addr+1, 0, 0); err == nil {
+		t.Error("write to another address succeeded")
+	}
+}
+
+func TestUnsupportedTransfers(t *testing.T) {
+	bus := pca9685sim.New(addr).I2CBus()
+	if _, err := bus.ReadByte(addr); err != pca9685sim.ErrUnsupported {
+		t.Errorf("ReadByte: %v, want %v", err, pca9685sim.ErrUnsupported)
+	}
+	if err := bus.WriteByte(addr, 0); err != pca9685sim.ErrUnsupported {
+		t.Errorf("WriteByte: %v, want %v", err, pca9685sim.ErrUnsupported)
+	}
+}
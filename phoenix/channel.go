@@ -0,0 +1,170 @@
+package phoenix
+
+import (
+	"sync"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// EventHandler handles a single inbound event.
+type EventHandler func(evt *Event)
+
+// Channel is a client-side view of one topic, modeled after the Phoenix JS
+// client's channel. Events for the topic are routed to the handler registered
+// for their event name; events without a handler fall through to the raw
+// event channel returned by Client.Start.
+type Channel struct {
+	client *Client
+	topic  string
+
+	mu       sync.Mutex
+	handlers map[string]EventHandler
+	presence *Presence
+}
+
+// Channel returns the channel for topic, creating it if needed. It does not
+// join the topic; call Join for that.
+func (c *Client) Channel(topic string) *Channel {
+	c.channelsMu.Lock()
+	defer c.channelsMu.Unlock()
+	if ch, ok := c.channels[topic]; ok {
+		return ch
+	}
+	ch := &Channel{
+		client:   c,
+		topic:    topic,
+		handlers: make(map[string]EventHandler),
+	}
+	c.channels[topic] = ch
+	return ch
+}
+
+// Topic returns the channel's topic.
+func (ch *Channel) Topic() string {
+	return ch.topic
+}
+
+// On registers h for events named event on this channel, replacing any
+// previous handler. Handlers run one at a time on the client's dispatch
+// goroutine; events that arrive while a handler is busy are queued as
+// configured by WithInboundQueue.
+func (ch *Channel) On(event string, h EventHandler) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.handlers[event] = h
+}
+
+// Off removes the handler for event.
+func (ch *Channel) Off(event string) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	delete(ch.handlers, event)
+}
+
+// Join subscribes to the channel's topic. See Client.Join.
+func (ch *Channel) Join(payload []byte) {
+	ch.client.Join(ch.topic, payload)
+}
+
+// JoinFunc subscribes to the channel's topic. See Client.JoinFunc.
+func (ch *Channel) JoinFunc(f TopicJoinFunc) {
+	ch.client.JoinFunc(ch.topic, f)
+}
+
+// Leave unsubscribes from the channel's topic. Registered handlers are kept.
+func (ch *Channel) Leave() {
+	ch.client.Leave(ch.topic)
+}
+
+// Push sends event on the channel's topic. See Client.Push.
+func (ch *Channel) Push(ctx context.Context, event string, payload []byte) (*Reply, error) {
+	return ch.client.Push(ctx, ch.topic, event, payload)
+}
+
+// PushBinary sends event with a raw payload on the channel's topic. See
+// Client.PushBinary.
+func (ch *Channel) PushBinary(ctx context.Context, event string, payload []byte) (*Reply, error) {
+	return ch.client.PushBinary(ctx, ch.topic, event, payload)
+}
+
+// State returns the join state of the channel's topic.
+func (ch *Channel) State() TopicState {
+	return ch.client.TopicState(ch.topic)
+}
+
+func (ch *Channel) handler(event string) EventHandler {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.handlers[event]
+}
+
+// afterJoinMessages returns the messages to send each time the channel's
+// topic is joined.
+func (ch *Channel) afterJoinMessages() []*Event {
+	ch.mu.Lock()
+	p := ch.presence
+	ch.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	if msg := p.trackMessage(); msg != nil {
+		return []*Event{msg}
+	}
+	return nil
+}
+
+// afterJoin sends the after-join messages of every channel joined since the
+// last call.
+func (c *Client) afterJoin(conn TransportConn) error {
+	topics := c.joinedTopics
+	c.joinedTopics = nil
+	for _, topic := range topics {
+		c.channelsMu.Lock()
+		ch, ok := c.channels[topic]
+		c.channelsMu.Unlock()
+		if !ok {
+			continue
+		}
+		for _, msg := range ch.afterJoinMessages() {
+			msg.Ref = c.makeRef()
+			if err := c.writeEvent(conn, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handlerFor returns the handler registered for evt's topic and event, or nil.
+func (c *Client) handlerFor(evt *Event) EventHandler {
+	c.channelsMu.Lock()
+	ch, ok := c.channels[evt.Topic]
+	c.channelsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return ch.handler(evt.Event)
+}
+
+// dispatchLoop runs channel handlers until the client is closed.
+func (c *Client) dispatchLoop() {
+	for {
+		select {
+		case evt := <-c.dispatchc:
+			if h := c.handlerFor(evt); h != nil {
+				h(evt)
+			}
+		case <-c.donec:
+			return
+		}
+	}
+}
+
+// deliver queues evt for its channel handler, or for the raw event channel if
+// there is none. It reports whether evt was queued.
+func (c *Client) deliver(evt *Event) bool {
+	if c.handlerFor(evt) != nil {
+		return c.enqueue(c.dispatchc, evt)
+	}
+	return c.enqueue(c.inboundc, evt)
+}
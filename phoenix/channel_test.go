@@ -0,0 +1,104 @@
+package phoenix_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// nextEvent returns the next event on events, failing the test if none comes.
+func nextEvent(t *testing.T, events <-chan *phoenix.Event) *phoenix.Event {
+	select {
+	case evt := <-events:
+		return evt
+	case <-time.After(waitFor):
+		t.Fatal("no event")
+	}
+	return nil
+}
+
+func TestChannelRouting(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := startClient(s)
+	defer c.Close()
+	c.Join("room:other", []byte("{}"))
+	events := c.Events()
+
+	handled := make(chan *phoenix.Event, 10)
+	ch := c.Channel(testTopic)
+	if c.Channel(testTopic) != ch || ch.Topic() != testTopic {
+		t.Fatal("Channel returned a different channel for the same topic")
+	}
+	ch.On("new_msg", func(evt *phoenix.Event) { handled <- evt })
+	waitUntil(t, "join", func() bool {
+		return ch.State() == phoenix.TopicJoined && c.TopicState("room:other") == phoenix.TopicJoined
+	})
+
+	// handled events go to the handler, the rest to the raw event channel
+	s.Broadcast(testTopic, "new_msg", map[string]int{"n": 1})
+	s.Broadcast(testTopic, "typing", map[string]int{"n": 2})
+	s.Broadcast("room:other", "new_msg", map[string]int{"n": 3})
+	if evt := nextEvent(t, handled); evt.Event != "new_msg" || string(evt.Payload) != `{"n":1}` {
+		t.Errorf("handler got %s %s", evt.Event, evt.Payload)
+	}
+	for _, want := range []string{`{"n":2}`, `{"n":3}`} {
+		if evt := nextEvent(t, events); string(evt.Payload) != want {
+			t.Errorf("raw event %s %s %s, want payload %s", evt.Topic, evt.Event, evt.Payload, want)
+		}
+	}
+
+	// On replaces the handler and Off removes it
+	replaced := make(chan *phoenix.Event, 10)
+	ch.On("new_msg", func(evt *phoenix.Event) { replaced <- evt })
+	s.Broadcast(testTopic, "new_msg", map[string]int{"n": 4})
+	if evt := nextEvent(t, replaced); string(evt.Payload) != `{"n":4}` {
+		t.Errorf("replacement handler got %s", evt.Payload)
+	}
+	ch.Off("new_msg")
+	s.Broadcast(testTopic, "new_msg", map[string]int{"n": 5})
+	if evt := nextEvent(t, events); string(evt.Payload) != `{"n":5}` {
+		t.Errorf("raw event after Off = %s", evt.Payload)
+	}
+	select {
+	case evt := <-handled:
+		t.Errorf("old handler got %s", evt.Payload)
+	case evt := <-replaced:
+		t.Errorf("removed handler got %s", evt.Payload)
+	default:
+	}
+}
+
+func TestChannelJoinLeave(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := startClient(s)
+	defer c.Close()
+
+	ch := c.Channel("room:other")
+	if state := ch.State(); state != phoenix.TopicClosed {
+		t.Errorf("state before Join = %s", state)
+	}
+	ch.Join([]byte(`{"user":"gong"}`))
+	waitUntil(t, "join", func() bool { return ch.State() == phoenix.TopicJoined })
+	join, err := s.WaitForEvent("room:other", "phx_join", waitFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(join.Payload) != `{"user":"gong"}` {
+		t.Errorf("join payload = %s", join.Payload)
+	}
+
+	ch.Leave()
+	if _, err := s.WaitForEvent("room:other", "phx_leave", waitFor); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "leave", func() bool { return ch.State() == phoenix.TopicClosed })
+	for _, topic := range c.Topics() {
+		if topic == "room:other" {
+			t.Error("left topic still subscribed")
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package phoenix_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+const testTopic = "room:lobby"
+
+// waitFor is how long the tests wait for the client to react to the server.
+const waitFor = 5 * time.Second
+
+// waitUntil fails the test if cond does not become true within waitFor.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(waitFor)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// joins counts the phx_joins of testTopic the server has received.
+func joins(s *phoenixtest.Server) int {
+	n := 0
+	for _, evt := range s.Received() {
+		if evt.Topic == testTopic && evt.Event == "phx_join" {
+			n++
+		}
+	}
+	return n
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use, for logging
+// from the client's goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func startClient(s *phoenixtest.Server, opts ...phoenix.Option) *phoenix.Client {
+	opts = append([]phoenix.Option{phoenix.WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond)}, opts...)
+	c := phoenix.InitClient(s.URL, []string{testTopic}, []byte("{}"), opts...)
+	c.Start()
+	return c
+}
+
+func TestReconnectAfterDroppedConnection(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := startClient(s)
+	defer c.Close()
+
+	received := make(chan string, 1)
+	c.Channel(testTopic).On("new_msg", func(evt *phoenix.Event) {
+		received <- string(evt.Payload)
+	})
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	s.DropConnections()
+	waitUntil(t, "rejoin", func() bool {
+		return joins(s) == 2 && c.TopicState(testTopic) == phoenix.TopicJoined
+	})
+	if got := c.Status().Reconnects; got != 1 {
+		t.Errorf("Reconnects = %d, want 1", got)
+	}
+
+	if n, err := s.Broadcast(testTopic, "new_msg", map[string]string{"body": "hi"}); err != nil || n != 1 {
+		t.Fatalf("Broadcast = %d, %v; want 1 connection", n, err)
+	}
+	select {
+	case payload := <-received:
+		if payload != `{"body":"hi"}` {
+			t.Errorf("payload = %s", payload)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("broadcast after reconnect not delivered")
+	}
+}
+
+func TestJoinError(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	s.SetJoinReply(testTopic, phoenixtest.Reply{
+		Status:   "error",
+		Response: map[string]string{"reason": "unauthorized"},
+	})
+
+	joinErrs := make(chan *phoenix.JoinError, 10)
+	c := phoenix.InitClient(s.URL, []string{testTopic}, []byte("{}"),
+		phoenix.WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond))
+	c.OnJoinError(func(err *phoenix.JoinError) { joinErrs <- err })
+	c.Start()
+	defer c.Close()
+
+	select {
+	case err := <-joinErrs:
+		if err.Topic != testTopic || err.Status != "error" || err.Reason != "unauthorized" {
+			t.Errorf("JoinError = %+v", err)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("no join error")
+	}
+	if state := c.TopicState(testTopic); state != phoenix.TopicRejoining {
+		t.Errorf("topic state after rejected join = %s, want %s", state, phoenix.TopicRejoining)
+	}
+	if state := c.Status().State; state != phoenix.StateConnected {
+		t.Errorf("client state after rejected join = %s, want %s", state, phoenix.StateConnected)
+	}
+
+	// the rejoin after the first backoff step succeeds on the same connection
+	s.SetJoinReply(testTopic, phoenixtest.OK)
+	waitUntil(t, "rejoin", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+	if got := c.Status().Reconnects; got != 0 {
+		t.Errorf("Reconnects = %d, want 0", got)
+	}
+}
+
+// testStalledServer checks that the client given opts drops a connection to
+// a server that stops answering, and reconnects once it answers again.
+func testStalledServer(t *testing.T, opts ...phoenix.Option) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := startClient(s, opts...)
+	defer c.Close()
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	status, stop := c.Subscribe()
+	defer stop()
+	s.Stall(true)
+	deadline := time.After(waitFor)
+	for disconnected := false; !disconnected; {
+		select {
+		case st := <-status:
+			disconnected = st.State == phoenix.StateDisconnected
+		case <-deadline:
+			t.Fatal("client kept the stalled connection")
+		}
+	}
+
+	s.Stall(false)
+	waitUntil(t, "rejoin", func() bool {
+		return c.Status().State == phoenix.StateJoined && c.Status().Reconnects > 0
+	})
+}
+
+func TestMissedHeartbeats(t *testing.T) {
+	testStalledServer(t,
+		phoenix.WithHeartbeatInterval(20*time.Millisecond),
+		phoenix.WithMaxMissedHeartbeats(2))
+}
+
+func TestInactivityTimeout(t *testing.T) {
+	testStalledServer(t,
+		phoenix.WithHeartbeatInterval(20*time.Millisecond),
+		phoenix.WithMaxMissedHeartbeats(0),
+		phoenix.WithInactivityTimeout(200*time.Millisecond))
+}
+
+func TestPushResentAfterRejoin(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	// Only the 2.0.0 protocol carries join refs.
+	c := startClient(s, phoenix.WithSerializer(phoenix.V2Serializer{}))
+	defer c.Close()
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	// The channel crashes while handling the first push, and its reply only
+	// goes out after the client has started rejoining, so it is stale.
+	var mu sync.Mutex
+	pushes := 0
+	s.SetPushHandler(func(evt phoenix.Event) phoenixtest.Reply {
+		mu.Lock()
+		pushes++
+		first := pushes == 1
+		mu.Unlock()
+		if first {
+			s.Broadcast(testTopic, "phx_error", map[string]interface{}{})
+			deadline := time.Now().Add(waitFor)
+			for c.TopicState(testTopic) != phoenix.TopicJoining && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		return phoenixtest.OK
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	reply, err := c.Push(ctx, testTopic, "new_msg", []byte(`{"body":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Status != "ok" {
+		t.Errorf("reply status = %q", reply.Status)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if pushes != 2 {
+		t.Errorf("server saw %d pushes, want 2", pushes)
+	}
+}
+
+func TestRunLeavesOnCancel(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := phoenix.InitClient(s.URL, []string{testTopic}, []byte("{}"))
+	events := c.Events()
+
+	// a handler still running when ctx is done is waited for
+	started := make(chan struct{})
+	var finished bool
+	c.Channel(testTopic).On("slow", func(*phoenix.Event) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		finished = true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+	s.Broadcast(testTopic, "slow", map[string]interface{}{})
+	<-started
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("Run returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("Run did not return")
+	}
+	if !finished {
+		t.Error("Run returned before the running handler")
+	}
+	if _, err := s.WaitForEvent(testTopic, "phx_leave", 0); err != nil {
+		t.Error("no phx_leave before Run returned")
+	}
+	if _, ok := <-events; ok {
+		t.Error("event channel still open")
+	}
+	if state := c.Status().State; state != phoenix.StateClosed {
+		t.Errorf("state after Run = %s", state)
+	}
+}
+
+func TestCloseWithoutStart(t *testing.T) {
+	c := phoenix.InitClient("ws://localhost/socket/websocket", []string{testTopic}, nil)
+	c.Close()
+
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c = startClient(s)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	if state := c.Status().State; state != phoenix.StateClosed {
+		t.Errorf("state after concurrent Close calls = %s", state)
+	}
+}
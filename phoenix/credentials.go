@@ -0,0 +1,125 @@
+package phoenix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Credentials authenticate the client to the server.
+type Credentials struct {
+	// Params are set on the socket URL's query when dialing, replacing any
+	// values already there.
+	Params url.Values
+	// JoinParams are set on the payload of every phx_join, which must then
+	// be a JSON object.
+	JoinParams map[string]interface{}
+}
+
+// CredentialsFunc returns the credentials to connect or join with. It is
+// called before every dial and every join, so it should return cached
+// credentials cheaply. refresh is true when the server rejected the last
+// ones, either with a 401 or 403 handshake response or with an
+// "unauthorized" join reply, and new ones should be fetched.
+type CredentialsFunc func(refresh bool) (Credentials, error)
+
+// WithCredentials makes the client ask f for credentials before each dial and
+// join instead of relying on ones baked into the URL and join payloads. If f
+// fails, the dial or join is retried later.
+func WithCredentials(f CredentialsFunc) Option {
+	return func(c *Client) {
+		c.credentialsFunc = f
+	}
+}
+
+// HandshakeError reports a connection the server refused with an HTTP
+// status.
+type HandshakeError struct {
+	StatusCode int
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("phoenix: handshake refused with status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// isUnauthorized reports whether err means the server rejected the client's
+// credentials.
+func isUnauthorized(err error) bool {
+	herr, ok := err.(*HandshakeError)
+	return ok && (herr.StatusCode == http.StatusUnauthorized || herr.StatusCode == http.StatusForbidden)
+}
+
+// credentials calls the credentials function, asking for a refresh if the
+// server rejected the last credentials. It is only called from the connection
+// goroutine.
+func (c *Client) credentials() (Credentials, error) {
+	creds, err := c.credentialsFunc(c.credentialsRejected)
+	if err != nil {
+		return Credentials{}, err
+	}
+	c.credentialsRejected = false
+	return creds, nil
+}
+
+// dialURL returns the URL to dial, with the current credentials if there is a
+// credentials function.
+func (c *Client) dialURL() (string, error) {
+	if c.credentialsFunc == nil {
+		return c.u, nil
+	}
+	creds, err := c.credentials()
+	if err != nil {
+		return "", fmt.Errorf("getting credentials: %s", err)
+	}
+	u, err := url.Parse(c.u)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for k, v := range creds.Params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// credentialsJoinPayload returns the join payload for topic with the current
+// credentials added, if there is a credentials function.
+func (c *Client) credentialsJoinPayload(topic string, payload []byte) ([]byte, error) {
+	if c.credentialsFunc == nil {
+		return payload, nil
+	}
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, fmt.Errorf("getting credentials: %s", err)
+	}
+	if len(creds.JoinParams) == 0 {
+		return payload, nil
+	}
+	withCreds, err := setPayloadFields(payload, creds.JoinParams)
+	if err != nil {
+		return nil, fmt.Errorf("join payload for %s: %s", topic, err)
+	}
+	return withCreds, nil
+}
+
+// setPayloadFields returns the JSON object payload with fields set on it. An
+// empty payload counts as an empty object.
+func setPayloadFields(payload []byte, fields map[string]interface{}) ([]byte, error) {
+	obj := make(map[string]json.RawMessage)
+	if len(bytes.TrimSpace(payload)) > 0 {
+		if err := json.Unmarshal(payload, &obj); err != nil {
+			return payload, fmt.Errorf("not a JSON object: %s", err)
+		}
+	}
+	for k, v := range fields {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return payload, err
+		}
+		obj[k] = raw
+	}
+	return json.Marshal(obj)
+}
@@ -0,0 +1,128 @@
+package phoenix_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// tokenSource hands out the token "t<n>", where n counts the refreshes asked
+// for so far.
+type tokenSource struct {
+	mu        sync.Mutex
+	refreshes int
+}
+
+func (ts *tokenSource) credentials(refresh bool) (phoenix.Credentials, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if refresh {
+		ts.refreshes++
+	}
+	token := fmt.Sprintf("t%d", ts.refreshes)
+	return phoenix.Credentials{
+		Params:     url.Values{"token": {token}},
+		JoinParams: map[string]interface{}{"token": token},
+	}, nil
+}
+
+func (ts *tokenSource) token() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return fmt.Sprintf("t%d", ts.refreshes)
+}
+
+// joinToken returns the token in the payload of the last join the server
+// received.
+func joinToken(t *testing.T, s *phoenixtest.Server) string {
+	var token string
+	for _, evt := range s.Received() {
+		if evt.Topic != testTopic || evt.Event != "phx_join" {
+			continue
+		}
+		var payload struct{ Token string }
+		if err := json.Unmarshal(evt.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		token = payload.Token
+	}
+	return token
+}
+
+func TestCredentialsRefreshedAfterRefusedHandshake(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		s := phoenixtest.NewServer()
+		s.SetHandshakeStatus(status)
+		ts := &tokenSource{}
+		c := startClient(s, phoenix.WithCredentials(ts.credentials))
+		waitUntil(t, "refused handshakes", func() bool { return len(s.Requests()) >= 2 })
+		s.SetHandshakeStatus(0)
+		waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+		c.Close()
+		s.Close()
+
+		reqs := s.Requests()
+		if got := reqs[0].URL.Query().Get("token"); got != "t0" {
+			t.Errorf("%d: first handshake has token %q", status, got)
+		}
+		token := ts.token()
+		if token == "t0" {
+			t.Errorf("%d: credentials not refreshed", status)
+		}
+		if got := reqs[len(reqs)-1].URL.Query().Get("token"); got != token {
+			t.Errorf("%d: accepted handshake has token %q, want %q", status, got, token)
+		}
+		if got := joinToken(t, s); got != token {
+			t.Errorf("%d: joined with token %q, want %q", status, got, token)
+		}
+	}
+}
+
+func TestCredentialsRefreshedAfterUnauthorizedJoin(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	s.SetJoinReply(testTopic, phoenixtest.Reply{Status: "error", Response: map[string]string{"reason": "unauthorized"}})
+	ts := &tokenSource{}
+	c := startClient(s, phoenix.WithCredentials(ts.credentials))
+	defer c.Close()
+	waitUntil(t, "rejected join", func() bool { return joins(s) >= 1 })
+	if got := joinToken(t, s); got != "t0" {
+		t.Errorf("first join has token %q", got)
+	}
+
+	s.SetJoinReply(testTopic, phoenixtest.OK)
+	waitUntil(t, "rejoin", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+	if token := ts.token(); token == "t0" {
+		t.Error("credentials not refreshed")
+	} else if got := joinToken(t, s); got != token {
+		t.Errorf("rejoined with token %q, want %q", got, token)
+	}
+}
+
+func TestCredentialsKeptAfterOtherFailures(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	s.SetHandshakeStatus(http.StatusInternalServerError)
+	s.SetJoinReply(testTopic, phoenixtest.Reply{Status: "error", Response: map[string]string{"reason": "unmatched topic"}})
+	ts := &tokenSource{}
+	c := startClient(s, phoenix.WithCredentials(ts.credentials))
+	defer c.Close()
+	waitUntil(t, "refused handshakes", func() bool { return len(s.Requests()) >= 3 })
+	s.SetHandshakeStatus(0)
+	waitUntil(t, "rejected joins", func() bool { return joins(s) >= 2 })
+
+	if token := ts.token(); token != "t0" {
+		t.Errorf("credentials refreshed to %s", token)
+	}
+	for _, r := range s.Requests() {
+		if got := r.URL.Query().Get("token"); got != "t0" {
+			t.Errorf("handshake has token %q", got)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package phoenix
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/gorilla/websocket"
+)
+
+// The vendored websocket package predates compression support, so
+// permessage-deflate (RFC 7692) is handled underneath it: deflateConn wraps
+// the network connection, inflates compressed messages from the server and
+// hands the websocket package plain frames. Messages to the server are sent
+// uncompressed, which the extension allows; the client's pushes are small.
+
+const (
+	// deflateOffer asks the server to compress its messages.
+	deflateOffer = "permessage-deflate; client_no_context_takeover"
+
+	// maxInflatedSize bounds the size of a message before and after
+	// decompression.
+	maxInflatedSize = 16 << 20
+
+	// deflateWindowSize is the largest LZ77 window the server may use.
+	deflateWindowSize = 32 << 10
+
+	// deflateTail completes a message's deflate stream: the sync flush
+	// trailer the sender strips, then an empty final block.
+	deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+	finalBit = 0x80
+	rsv1Bit  = 0x40
+	maskBit  = 0x80
+)
+
+var (
+	errMessageTooLarge = errors.New("phoenix: compressed message too large")
+	errBadCompression  = errors.New("phoenix: unexpected compressed frame")
+)
+
+// WithCompression offers permessage-deflate when connecting, so that servers
+// supporting it compress the messages they send.
+func WithCompression() Option {
+	return func(c *Client) {
+		c.compress = true
+	}
+}
+
+// dialDeflate dials rawurl with d, offering permessage-deflate. TLS for wss
+// URLs is set up here rather than by d, since frames can only be rewritten
+// below TLS.
+func dialDeflate(d *websocket.Dialer, rawurl string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := make(http.Header)
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Set("Sec-WebSocket-Extensions", deflateOffer)
+
+	secure := u.Scheme == "wss"
+	hostname := u.Host
+	if host, _, err := net.SplitHostPort(u.Host); err == nil {
+		hostname = host
+	} else if secure {
+		u.Host = net.JoinHostPort(u.Host, "443")
+	}
+	if secure {
+		// Dial as ws so the dialer leaves TLS to us, but keep the Host
+		// header the server expects.
+		if h.Get("Host") == "" {
+			h.Set("Host", strings.TrimSuffix(u.Host, ":443"))
+		}
+		u.Scheme = "ws"
+	}
+
+	forward := d.NetDial
+	if forward == nil {
+		forward = (&net.Dialer{Timeout: d.HandshakeTimeout}).Dial
+	}
+	dd := *d
+	dd.NetDial = func(network, addr string) (net.Conn, error) {
+		conn, err := forward(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if secure {
+			if conn, err = tlsHandshake(conn, d.TLSClientConfig, hostname, d.HandshakeTimeout); err != nil {
+				return nil, err
+			}
+		}
+		return newDeflateConn(conn), nil
+	}
+	return dd.Dial(u.String(), h)
+}
+
+// tlsHandshake wraps conn in a TLS client connection to hostname, the same
+// way the websocket dialer does for wss URLs.
+func tlsHandshake(conn net.Conn, cfg *tls.Config, hostname string, timeout time.Duration) (net.Conn, error) {
+	if cfg == nil {
+		cfg = &tls.Config{ServerName: hostname}
+	} else if cfg.ServerName == "" {
+		// Copy the fields a client config normally sets; copying the whole
+		// struct would copy its internal locks.
+		cfg = &tls.Config{
+			ServerName:         hostname,
+			RootCAs:            cfg.RootCAs,
+			Certificates:       cfg.Certificates,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+			CipherSuites:       cfg.CipherSuites,
+			MinVersion:         cfg.MinVersion,
+			MaxVersion:         cfg.MaxVersion,
+		}
+	}
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !cfg.InsecureSkipVerify {
+		if err := tlsConn.VerifyHostname(cfg.ServerName); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return tlsConn, nil
+}
+
+// deflateConn passes the handshake response through unchanged, then rewrites
+// each compressed message from the server into a single uncompressed frame.
+// Writes go straight to the underlying connection.
+type deflateConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// out holds rewritten bytes waiting to be read.
+	out bytes.Buffer
+	// sawStatus and upgraded track the handshake response. Once it is known
+	// not to be a successful upgrade, passthrough is set and nothing more is
+	// rewritten.
+	sawStatus   bool
+	upgraded    bool
+	passthrough bool
+
+	// msg collects a compressed message split over several frames, and
+	// msgOpcode is the opcode of its first frame.
+	inMsg     bool
+	msgOpcode byte
+	msg       bytes.Buffer
+	// window holds the most recently inflated bytes, which the server may
+	// refer back to unless it agreed to server_no_context_takeover.
+	window []byte
+}
+
+func newDeflateConn(conn net.Conn) *deflateConn {
+	return &deflateConn{Conn: conn, br: bufio.NewReader(conn)}
+}
+
+func (c *deflateConn) Read(p []byte) (int, error) {
+	for c.out.Len() == 0 {
+		var err error
+		switch {
+		case c.passthrough:
+			return c.br.Read(p)
+		case !c.upgraded:
+			err = c.readHandshakeLine()
+		default:
+			err = c.readFrame()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.out.Read(p)
+}
+
+func (c *deflateConn) readHandshakeLine() error {
+	line, err := c.br.ReadBytes('\n')
+	c.out.Write(line)
+	if err != nil {
+		return err
+	}
+	if !c.sawStatus {
+		c.sawStatus = true
+		if !bytes.Contains(line, []byte(" 101 ")) {
+			c.passthrough = true
+		}
+		return nil
+	}
+	if len(bytes.TrimRight(line, "\r\n")) == 0 {
+		c.upgraded = true
+	}
+	return nil
+}
+
+// readFrame reads one frame from the server. Control frames and uncompressed
+// messages are copied to out as they are; the last frame of a compressed
+// message produces the inflated message.
+func (c *deflateConn) readFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	raw := append([]byte(nil), hdr[:]...)
+
+	var ext []byte
+	switch hdr[1] &^ maskBit {
+	case 126:
+		ext = make([]byte, 2)
+	case 127:
+		ext = make([]byte, 8)
+	}
+	var key []byte
+	if hdr[1]&maskBit != 0 {
+		key = make([]byte, 4)
+	}
+	for _, p := range [][]byte{ext, key} {
+		if _, err := io.ReadFull(c.br, p); err != nil {
+			return err
+		}
+		raw = append(raw, p...)
+	}
+
+	n := uint64(hdr[1] &^ maskBit)
+	switch len(ext) {
+	case 2:
+		n = uint64(binary.BigEndian.Uint16(ext))
+	case 8:
+		n = binary.BigEndian.Uint64(ext)
+	}
+	if n > maxInflatedSize {
+		return errMessageTooLarge
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+
+	opcode := hdr[0] & 0x0f
+	compressed := hdr[0]&rsv1Bit != 0
+	isControl := opcode >= 8
+	if isControl || (!compressed && !c.inMsg) {
+		c.out.Write(raw)
+		c.out.Write(payload)
+		return nil
+	}
+
+	switch {
+	case compressed && (opcode == 0 || c.inMsg):
+		return errBadCompression
+	case compressed:
+		c.inMsg = true
+		c.msgOpcode = opcode
+		c.msg.Reset()
+	case opcode != 0:
+		// A new message may not start inside a fragmented one.
+		return errBadCompression
+	}
+	for i := range payload {
+		if key != nil {
+			payload[i] ^= key[i%4]
+		}
+	}
+	c.msg.Write(payload)
+	if c.msg.Len() > maxInflatedSize {
+		return errMessageTooLarge
+	}
+	if hdr[0]&finalBit == 0 {
+		return nil
+	}
+
+	c.inMsg = false
+	data, err := c.inflate(c.msg.Bytes())
+	if err != nil {
+		return err
+	}
+	writeFrameHeader(&c.out, c.msgOpcode, len(data))
+	c.out.Write(data)
+	return nil
+}
+
+func (c *deflateConn) inflate(p []byte) ([]byte, error) {
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(p), strings.NewReader(deflateTail)), c.window)
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxInflatedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxInflatedSize {
+		return nil, errMessageTooLarge
+	}
+
+	c.window = append(c.window, data...)
+	if len(c.window) > deflateWindowSize {
+		c.window = append([]byte(nil), c.window[len(c.window)-deflateWindowSize:]...)
+	}
+	return data, nil
+}
+
+// writeFrameHeader writes the header of an unmasked, unfragmented frame.
+func writeFrameHeader(w *bytes.Buffer, opcode byte, n int) {
+	w.WriteByte(finalBit | opcode)
+	switch {
+	case n < 126:
+		w.WriteByte(byte(n))
+	case n <= 0xffff:
+		w.WriteByte(126)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(127)
+		binary.Write(w, binary.BigEndian, uint64(n))
+	}
+}
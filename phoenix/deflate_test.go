@@ -0,0 +1,260 @@
+package phoenix_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/phoenix"
+)
+
+// Frame opcodes and header bits used by the raw server.
+const (
+	opText         = 1
+	opContinuation = 0
+	opPing         = 9
+	opPong         = 10
+
+	frameFinal = 0x80
+	frameRSV1  = 0x40
+)
+
+// frame is a websocket frame from the client, unmasked.
+type frame struct {
+	opcode  byte
+	payload []byte
+}
+
+// rawServer is a websocket server written against the wire format, so that
+// tests can send compressed frames the vendored websocket package cannot.
+type rawServer struct {
+	conn net.Conn
+	br   *bufio.Reader
+	req  *http.Request
+}
+
+// acceptDeflate accepts a connection on ln and completes the handshake,
+// agreeing to permessage-deflate with context takeover on the server side.
+func acceptDeflate(t *testing.T, ln net.Listener) *rawServer {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(waitFor))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha1.New()
+	io.WriteString(h, req.Header.Get("Sec-WebSocket-Key")+"258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(h.Sum(nil))+"\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate; client_no_context_takeover\r\n\r\n")
+	return &rawServer{conn: conn, br: br, req: req}
+}
+
+// writeFrame writes an unmasked frame with the given header bits.
+func (s *rawServer) writeFrame(bits, opcode byte, payload []byte) error {
+	hdr := []byte{bits | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, 126, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	default:
+		hdr = append(hdr, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+	_, err := s.conn.Write(append(hdr, payload...))
+	return err
+}
+
+// readFrame reads a masked frame from the client.
+func (s *rawServer) readFrame() (frame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(s.br, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(s.br, ext[:]); err != nil {
+			return frame{}, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(s.br, ext[:]); err != nil {
+			return frame{}, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var key [4]byte
+	if _, err := io.ReadFull(s.br, key[:]); err != nil {
+		return frame{}, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(s.br, payload); err != nil {
+		return frame{}, err
+	}
+	for i := range payload {
+		payload[i] ^= key[i%4]
+	}
+	return frame{hdr[0] & 0x0f, payload}, nil
+}
+
+// compressor compresses messages for one connection, keeping its window
+// across messages.
+type compressor struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newCompressor() *compressor {
+	c := &compressor{}
+	c.w, _ = flate.NewWriter(&c.buf, flate.BestCompression)
+	return c
+}
+
+// compress returns msg as the payload of a compressed message: the deflate
+// output up to a sync flush, less the flush's trailing empty block.
+func (c *compressor) compress(msg []byte) []byte {
+	c.buf.Reset()
+	c.w.Write(msg)
+	c.w.Flush()
+	return append([]byte(nil), bytes.TrimSuffix(c.buf.Bytes(), []byte{0, 0, 0xff, 0xff})...)
+}
+
+func TestCompressedFrames(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c := phoenix.InitClient("ws://"+ln.Addr().String()+"/socket/websocket", []string{testTopic}, []byte("{}"),
+		phoenix.WithCompression(),
+		phoenix.WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond))
+	received := make(chan string, 10)
+	c.Channel(testTopic).On("new_msg", func(evt *phoenix.Event) {
+		received <- string(evt.Payload)
+	})
+	c.Start()
+	defer c.Close()
+
+	s := acceptDeflate(t, ln)
+	defer s.conn.Close()
+	if ext := s.req.Header.Get("Sec-WebSocket-Extensions"); !strings.HasPrefix(ext, "permessage-deflate") {
+		t.Errorf("client offered extensions %q", ext)
+	}
+	var join phoenix.Event
+	for join.Event != "phx_join" {
+		f, err := s.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.opcode == opText {
+			if err := (phoenix.V1Serializer{}).Decode(f.payload, &join); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	frames := make(chan frame, 10)
+	go func() {
+		for {
+			f, err := s.readFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	message := func(evt phoenix.Event) []byte {
+		data, err := (phoenix.V1Serializer{}).Encode(&evt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	comp := newCompressor()
+
+	// the join reply comes compressed and split over three frames, with a
+	// ping between the first two
+	reply := comp.compress(message(phoenix.Event{
+		Topic:   testTopic,
+		Event:   "phx_reply",
+		Payload: json.RawMessage(`{"status":"ok","response":{}}`),
+		Ref:     join.Ref,
+	}))
+	third := len(reply) / 3
+	s.writeFrame(frameRSV1, opText, reply[:third])
+	s.writeFrame(frameFinal, opPing, []byte("between"))
+	s.writeFrame(0, opContinuation, reply[third:2*third])
+	s.writeFrame(frameFinal, opContinuation, reply[2*third:])
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+	deadline := time.After(waitFor)
+	for pong := false; !pong; {
+		select {
+		case f := <-frames:
+			pong = f.opcode == opPong && string(f.payload) == "between"
+		case <-deadline:
+			t.Fatal("ping between fragments not answered")
+		}
+	}
+
+	// a repeated message compresses to a back reference into the one
+	// before it, which the client must still have in its window
+	broadcast := message(phoenix.Event{
+		Topic:   testTopic,
+		Event:   "new_msg",
+		Payload: json.RawMessage(`{"body":"` + strings.Repeat("ding dong ", 20) + `"}`),
+	})
+	first := comp.compress(broadcast)
+	second := comp.compress(broadcast)
+	if len(second) >= len(first)/2 {
+		t.Fatalf("repeated message compressed to %d bytes, the first to %d", len(second), len(first))
+	}
+	s.writeFrame(frameFinal|frameRSV1, opText, first)
+	s.writeFrame(frameFinal|frameRSV1, opText, second)
+	// uncompressed messages pass through untouched
+	s.writeFrame(frameFinal, opText, message(phoenix.Event{
+		Topic:   testTopic,
+		Event:   "new_msg",
+		Payload: json.RawMessage(`{"body":"plain"}`),
+	}))
+
+	want := []string{
+		`{"body":"` + strings.Repeat("ding dong ", 20) + `"}`,
+		`{"body":"` + strings.Repeat("ding dong ", 20) + `"}`,
+		`{"body":"plain"}`,
+	}
+	for i, w := range want {
+		select {
+		case got := <-received:
+			if got != w {
+				t.Errorf("message %d = %s, want %s", i, got, w)
+			}
+		case <-time.After(waitFor):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+	if n := c.Status().Reconnects; n != 0 {
+		t.Errorf("%d reconnects", n)
+	}
+}
@@ -0,0 +1,119 @@
+package phoenix
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultMaxMissedHeartbeats = 2
+
+// heartbeatBuckets are the upper bounds of the heartbeat latency histogram.
+var heartbeatBuckets = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram summarizes heartbeat round-trip times.
+type LatencyHistogram struct {
+	// Buckets are the inclusive upper bounds of each bucket.
+	Buckets []time.Duration
+	// Counts has one entry per bucket plus a final entry for observations
+	// above the last bound.
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+	Min    time.Duration
+	Max    time.Duration
+}
+
+// Mean returns the average round-trip time, or zero if there are no
+// observations.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+type latencyHistogram struct {
+	mu sync.Mutex
+	h  LatencyHistogram
+}
+
+func (l *latencyHistogram) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.h.Counts == nil {
+		l.h.Buckets = heartbeatBuckets
+		l.h.Counts = make([]uint64, len(heartbeatBuckets)+1)
+	}
+	i := 0
+	for i < len(l.h.Buckets) && d > l.h.Buckets[i] {
+		i++
+	}
+	l.h.Counts[i]++
+	if l.h.Count == 0 || d < l.h.Min {
+		l.h.Min = d
+	}
+	if d > l.h.Max {
+		l.h.Max = d
+	}
+	l.h.Count++
+	l.h.Sum += d
+}
+
+func (l *latencyHistogram) snapshot() LatencyHistogram {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.h
+	h.Buckets = append([]time.Duration(nil), heartbeatBuckets...)
+	h.Counts = make([]uint64, len(heartbeatBuckets)+1)
+	copy(h.Counts, l.h.Counts)
+	return h
+}
+
+// HeartbeatLatency returns the distribution of heartbeat round-trip times
+// since the client was created.
+func (c *Client) HeartbeatLatency() LatencyHistogram {
+	return c.heartbeatLatency.snapshot()
+}
+
+// sendHeartbeat sends a heartbeat, or fails if too many earlier heartbeats
+// went unanswered.
+func (c *Client) sendHeartbeat(conn TransportConn) error {
+	if c.maxMissedHeartbeats > 0 && len(c.heartbeatsSent) >= c.maxMissedHeartbeats {
+		return fmt.Errorf("%d heartbeats missed", len(c.heartbeatsSent))
+	}
+
+	hbMsg := Event{
+		Topic:   "phoenix",
+		Event:   "heartbeat",
+		Payload: []byte("{}"),
+		Ref:     c.makeRef(),
+	}
+	c.heartbeatsSent[hbMsg.Ref] = time.Now()
+	return c.writeEvent(conn, &hbMsg)
+}
+
+// handleHeartbeatReply records the round trip of the heartbeat evt answers.
+// Any answer proves the connection alive, so older unanswered heartbeats are
+// forgotten rather than counted as missed.
+func (c *Client) handleHeartbeatReply(evt *Event) {
+	sent, ok := c.heartbeatsSent[evt.Ref]
+	if !ok {
+		return
+	}
+	rtt := time.Since(sent)
+	c.heartbeatsSent = make(map[string]time.Time)
+	c.heartbeatLatency.observe(rtt)
+	c.markHeartbeatReply(rtt)
+}
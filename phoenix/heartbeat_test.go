@@ -0,0 +1,74 @@
+package phoenix_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// slowConn delays every write, adding to the round trip of each message.
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(p)
+}
+
+func TestHeartbeatLatency(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := startClient(s,
+		phoenix.WithHeartbeatInterval(100*time.Millisecond),
+		phoenix.WithNetDial(func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &slowConn{Conn: conn, delay: delay}, nil
+		}))
+	defer c.Close()
+
+	if h := c.HeartbeatLatency(); h.Count != 0 || h.Mean() != 0 {
+		t.Errorf("histogram before any heartbeat = %+v", h)
+	}
+	waitUntil(t, "heartbeats", func() bool { return c.HeartbeatLatency().Count >= 3 })
+
+	h := c.HeartbeatLatency()
+	if len(h.Counts) != len(h.Buckets)+1 {
+		t.Fatalf("%d counts for %d buckets", len(h.Counts), len(h.Buckets))
+	}
+	var total uint64
+	for i, n := range h.Counts {
+		total += n
+		if n > 0 && i < len(h.Buckets) && h.Buckets[i] < delay {
+			t.Errorf("%d round trips of at most %s, all took over %s", n, h.Buckets[i], delay)
+		}
+	}
+	if total != h.Count {
+		t.Errorf("bucket counts add up to %d, want %d", total, h.Count)
+	}
+	if h.Min < delay || h.Min > h.Mean() || h.Mean() > h.Max {
+		t.Errorf("min %s, mean %s, max %s; want at least %s in order", h.Min, h.Mean(), h.Max, delay)
+	}
+
+	st := c.Status()
+	if st.Reconnects != 0 {
+		t.Errorf("%d reconnects", st.Reconnects)
+	}
+	if st.LastHeartbeatReply.IsZero() || st.LastHeartbeatRTT < delay {
+		t.Errorf("last heartbeat reply at %s after %s", st.LastHeartbeatReply, st.LastHeartbeatRTT)
+	}
+
+	// the histogram is a snapshot
+	h.Counts[0] = 1000
+	if c.HeartbeatLatency().Counts[0] == 1000 {
+		t.Error("changing a snapshot changed the client's histogram")
+	}
+}
@@ -0,0 +1,134 @@
+package phoenix
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel returns the level named s, as returned by Level.String.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("phoenix: unknown log level %q", s)
+}
+
+// Field is a key/value pair attached to a log message, such as the topic or
+// ref of the message it is about.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the client's log messages. It is called from several
+// goroutines at once.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...Field) {}
+
+// NewStdLogger returns a Logger that writes messages at min or above to l, one
+// line each, as the level and message followed by key=value fields.
+func NewStdLogger(l *log.Logger, min Level) Logger {
+	return &stdLogger{l: l, min: min}
+}
+
+type stdLogger struct {
+	l   *log.Logger
+	min Level
+}
+
+func (s *stdLogger) Log(level Level, msg string, fields ...Field) {
+	if level < s.min {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(strings.ToUpper(level.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for _, f := range fields {
+		v := fmt.Sprint(f.Value)
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&buf, " %s=%s", f.Key, v)
+	}
+	s.l.Output(2, buf.String())
+}
+
+// redacted stands in for values that must not be logged.
+const redacted = "[redacted]"
+
+// redactURL returns err without the query string and user info of the URL
+// in it if it is a *url.Error, as they may carry credentials.
+func redactURL(err error) error {
+	uerr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	u, perr := url.Parse(uerr.URL)
+	if perr != nil {
+		return &url.Error{Op: uerr.Op, URL: redacted, Err: uerr.Err}
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return &url.Error{Op: uerr.Op, URL: u.String(), Err: uerr.Err}
+}
+
+// eventFields describes evt for a log message. Payloads are left out; see
+// payloadField.
+func eventFields(evt *Event) []Field {
+	fields := []Field{{"topic", evt.Topic}, {"event", evt.Event}}
+	if evt.Ref != "" {
+		fields = append(fields, Field{"ref", evt.Ref})
+	}
+	if evt.JoinRef != "" {
+		fields = append(fields, Field{"join_ref", evt.JoinRef})
+	}
+	return fields
+}
+
+// payloadField returns evt's payload for a log message. Join payloads carry
+// credentials and are redacted.
+func payloadField(evt *Event) Field {
+	switch {
+	case evt.Event == "phx_join":
+		return Field{"payload", redacted}
+	case evt.Binary:
+		return Field{"payload", fmt.Sprintf("<%d bytes>", len(evt.Payload))}
+	}
+	return Field{"payload", string(evt.Payload)}
+}
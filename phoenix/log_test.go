@@ -0,0 +1,80 @@
+package phoenix_test
+
+import (
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+func TestLogRedactsURL(t *testing.T) {
+	// nothing listens on the port, so every poll fails with an error naming
+	// the URL
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var buf syncBuffer
+	c := phoenix.InitClient("ws://user:pass@"+addr+"/socket/websocket?guardian_token=secret", []string{testTopic}, []byte("{}"),
+		phoenix.WithTransports(1, &phoenix.LongPollTransport{}),
+		phoenix.WithLogger(phoenix.NewStdLogger(log.New(&buf, "", 0), phoenix.LevelDebug)))
+	c.Start()
+	waitUntil(t, "a failed poll", func() bool { return strings.Contains(buf.String(), "WARN disconnected") })
+	c.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, addr+"/socket/longpoll") {
+		t.Errorf("logged error does not name the URL:\n%s", out)
+	}
+	for _, secret := range []string{"secret", "guardian_token", "pass"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log contains %q:\n%s", secret, out)
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	var debug, info syncBuffer
+	for _, l := range []struct {
+		buf   *syncBuffer
+		level phoenix.Level
+	}{{&debug, phoenix.LevelDebug}, {&info, phoenix.LevelInfo}} {
+		c := phoenix.InitClient(s.URL, []string{testTopic}, []byte(`{"token":"secret"}`),
+			phoenix.WithLogger(phoenix.NewStdLogger(log.New(l.buf, "", 0), l.level)))
+		c.Start()
+		waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+		c.Close()
+	}
+
+	if !strings.Contains(debug.String(), "DEBUG sending topic=room:lobby event=phx_join") {
+		t.Errorf("join not logged at debug level:\n%s", debug.String())
+	}
+	if strings.Contains(debug.String(), "secret") || !strings.Contains(debug.String(), "payload=[redacted]") {
+		t.Errorf("join payload not redacted:\n%s", debug.String())
+	}
+	if strings.Contains(info.String(), "DEBUG") {
+		t.Errorf("debug lines logged at info level:\n%s", info.String())
+	}
+	if !strings.Contains(info.String(), "INFO joined topic=room:lobby") {
+		t.Errorf("join not logged at info level:\n%s", info.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for l := phoenix.LevelDebug; l <= phoenix.LevelError; l++ {
+		if got, err := phoenix.ParseLevel(strings.ToUpper(l.String())); got != l || err != nil {
+			t.Errorf("ParseLevel(%q) = %s, %v", strings.ToUpper(l.String()), got, err)
+		}
+	}
+	if _, err := phoenix.ParseLevel("verbose"); err == nil {
+		t.Error("parsed an unknown level")
+	}
+}
@@ -0,0 +1,251 @@
+package phoenix
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// LongPollTransport connects with Phoenix's long-polling transport, for
+// networks whose middleboxes break websockets. The server's messages are
+// fetched by repeatedly polling the longpoll endpoint next to the websocket
+// one, and each message to the server is a POST. Binary messages are not
+// supported.
+type LongPollTransport struct {
+	// Client makes the HTTP requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// longPollTransport returns a long-poll transport that dials the way the
+// client's websocket dialer does.
+func (c *Client) longPollTransport() *LongPollTransport {
+	return &LongPollTransport{
+		Client: &http.Client{
+			Transport: &http.Transport{
+				Dial:                c.dialer.NetDial,
+				TLSClientConfig:     c.dialer.TLSClientConfig,
+				TLSHandshakeTimeout: c.dialer.HandshakeTimeout,
+			},
+		},
+	}
+}
+
+func (t *LongPollTransport) Name() string { return "longpoll" }
+
+// Dial opens a long-poll session. The first poll carries no token; the server
+// answers it with status 410 and the token of a new session.
+func (t *LongPollTransport) Dial(rawurl string, header http.Header) (TransportConn, error) {
+	u, err := longPollURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c := &longPollConn{
+		client: client,
+		u:      u,
+		header: header,
+		closec: make(chan struct{}),
+	}
+	resp, err := c.do("GET", nil)
+	if lperr, ok := err.(*longPollError); ok {
+		return nil, &HandshakeError{StatusCode: lperr.status}
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Status {
+	case http.StatusGone:
+		return c, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, &HandshakeError{StatusCode: resp.Status}
+	}
+	return nil, &longPollError{resp.Status}
+}
+
+// longPollURL returns the longpoll endpoint for the websocket endpoint
+// rawurl, e.g. https://host/socket/longpoll for wss://host/socket/websocket.
+func longPollURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/websocket") + "/longpoll"
+	return u, nil
+}
+
+// longPollError reports a status other than the expected one in a long-poll
+// response.
+type longPollError struct {
+	status int
+}
+
+func (e *longPollError) Error() string {
+	return fmt.Sprintf("phoenix: long poll status %d", e.status)
+}
+
+// longPollResponse is the body of every long-poll response. The HTTP status
+// is always 200; the real one is in Status.
+type longPollResponse struct {
+	Status   int               `json:"status"`
+	Token    string            `json:"token"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+type longPollConn struct {
+	client *http.Client
+	u      *url.URL
+	header http.Header
+
+	mu     sync.Mutex
+	token  string
+	closed bool
+	closec chan struct{}
+
+	// pending holds messages from the last poll not yet returned by
+	// ReadMessage. It is only touched by the reading goroutine.
+	pending [][]byte
+}
+
+var errLongPollClosed = errors.New("phoenix: long poll session closed")
+
+// ReadMessage returns the next message from the last poll, polling again
+// until there is one.
+func (c *longPollConn) ReadMessage() ([]byte, bool, error) {
+	for len(c.pending) == 0 {
+		resp, err := c.do("GET", nil)
+		if err != nil {
+			return nil, false, err
+		}
+		switch resp.Status {
+		case http.StatusOK:
+			for _, msg := range resp.Messages {
+				c.pending = append(c.pending, unwrapLongPollMessage(msg))
+			}
+		case http.StatusNoContent:
+			// The poll window elapsed without messages.
+		default:
+			return nil, false, &longPollError{resp.Status}
+		}
+	}
+	msg := c.pending[0]
+	c.pending = c.pending[1:]
+	return msg, false, nil
+}
+
+// unwrapLongPollMessage returns the encoded message msg carries. Protocol
+// version 2 sends each message as a JSON string holding its encoding, while
+// version 1 embeds the message object itself.
+func unwrapLongPollMessage(msg json.RawMessage) []byte {
+	var s string
+	if err := json.Unmarshal(msg, &s); err == nil {
+		return []byte(s)
+	}
+	return msg
+}
+
+func (c *longPollConn) WriteMessage(data []byte, binary bool) error {
+	if binary {
+		return ErrBinaryUnsupported
+	}
+	resp, err := c.do("POST", data)
+	if err != nil {
+		return err
+	}
+	if resp.Status != http.StatusOK {
+		return &longPollError{resp.Status}
+	}
+	return nil
+}
+
+// Shutdown closes the connection. A long-poll session has no close
+// handshake; it expires on the server once polling stops, and every message
+// written before has already been accepted.
+func (c *longPollConn) Shutdown() error {
+	return c.Close()
+}
+
+// Close cancels any request in flight and fails later ones.
+func (c *longPollConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.closec)
+	}
+	return nil
+}
+
+func (c *longPollConn) RemoteAddr() string {
+	return c.u.Host
+}
+
+// do makes a long-poll request with the session token and decodes the
+// response, remembering the token it carries.
+func (c *longPollConn) do(method string, body []byte) (*longPollResponse, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errLongPollClosed
+	}
+	u := *c.u
+	if c.token != "" {
+		q := u.Query()
+		q.Set("token", c.token)
+		u.RawQuery = q.Encode()
+	}
+	c.mu.Unlock()
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, redactURL(err)
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Cancel = c.closec
+
+	httpResp, err := c.client.Do(req)
+	if err != nil {
+		// the URL carries the session token and any credentials
+		return nil, redactURL(err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, httpResp.Body)
+		return nil, &longPollError{httpResp.StatusCode}
+	}
+	resp := &longPollResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, fmt.Errorf("decoding long poll response: %s", err)
+	}
+
+	if resp.Token != "" {
+		c.mu.Lock()
+		c.token = resp.Token
+		c.mu.Unlock()
+	}
+	return resp, nil
+}
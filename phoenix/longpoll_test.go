@@ -0,0 +1,94 @@
+package phoenix_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// longPolls counts the long-poll requests the server has received.
+func longPolls(s *phoenixtest.Server) int {
+	n := 0
+	for _, r := range s.Requests() {
+		if strings.HasSuffix(r.URL.Path, "/longpoll") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLongPollFallback(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	s.DisableWebSocket(true)
+	s.SetPushHandler(echo)
+	c := startClient(s, phoenix.WithLongPollFallback(2))
+	defer c.Close()
+	received := make(chan string, 1)
+	c.Channel(testTopic).On("new_msg", func(evt *phoenix.Event) {
+		received <- string(evt.Payload)
+	})
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+	if longPolls(s) == 0 {
+		t.Fatal("joined without long polling")
+	}
+	if n := s.ConnCount(); n != 1 {
+		t.Errorf("server has %d connections", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	reply, err := c.Push(ctx, testTopic, "new_msg", []byte(`{"body":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.OK() || string(reply.Response) != `{"echo":{"body":"hi"}}` {
+		t.Errorf("reply = %+v", reply)
+	}
+
+	if n, err := s.Broadcast(testTopic, "new_msg", map[string]string{"body": "ding"}); n != 1 || err != nil {
+		t.Fatalf("broadcast reached %d clients: %v", n, err)
+	}
+	select {
+	case got := <-received:
+		if got != `{"body":"ding"}` {
+			t.Errorf("received %s", got)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("broadcast not received over long poll")
+	}
+}
+
+func TestLongPollTransport(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	s.DisableWebSocket(true)
+	c := startClient(s,
+		phoenix.WithSerializer(phoenix.V2Serializer{}),
+		phoenix.WithTransports(1, &phoenix.LongPollTransport{}))
+	defer c.Close()
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	// binary messages cannot be carried, but only the push fails
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	if _, err := c.PushBinary(ctx, testTopic, "upload", []byte{1, 2}); err != phoenix.ErrBinaryUnsupported {
+		t.Errorf("binary push over long poll: %v, want %v", err, phoenix.ErrBinaryUnsupported)
+	}
+	if _, err := c.Push(ctx, testTopic, "new_msg", []byte(`{}`)); err != nil {
+		t.Errorf("push after binary push: %s", err)
+	}
+	if n := c.Status().Reconnects; n != 0 {
+		t.Errorf("%d reconnects", n)
+	}
+
+	// leaving is sent as a POST like any other message
+	c.Channel(testTopic).Leave()
+	if _, err := s.WaitForEvent(testTopic, "phx_leave", waitFor); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,191 @@
+package phoenix
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/gorilla/websocket"
+)
+
+// Option configures a Client in InitClient.
+type Option func(*Client)
+
+// WithSerializer selects the protocol version spoken by the client. The
+// default is V1Serializer.
+func WithSerializer(s Serializer) Option {
+	return func(c *Client) {
+		c.serializer = s
+	}
+}
+
+// WithHeartbeatInterval sets how often a heartbeat is sent. The default is
+// 30 seconds.
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(c *Client) {
+		c.heartbeatInterval = d
+	}
+}
+
+// WithInactivityTimeout sets how long the connection may go without any
+// inbound message before it is considered dead. The default is one minute.
+func WithInactivityTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.inactivityTimeout = d
+	}
+}
+
+// WithMaxMissedHeartbeats sets how many consecutive heartbeats may go
+// unanswered before the connection is considered dead and redialed. Zero
+// disables the check, leaving only the inactivity timeout. The default is 2.
+func WithMaxMissedHeartbeats(n int) Option {
+	return func(c *Client) {
+		c.maxMissedHeartbeats = n
+	}
+}
+
+// WithHandshakeTimeout sets the websocket handshake timeout. The default is
+// 10 seconds.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.dialer.HandshakeTimeout = d
+	}
+}
+
+// WithReconnectBackoff sets the bounds of the exponential backoff between
+// reconnect attempts. The defaults are 100ms and 10s.
+func WithReconnectBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.reconnectBackoff.Min = min
+		c.reconnectBackoff.Max = max
+	}
+}
+
+// WithDialer replaces the websocket dialer. Options that adjust the dialer,
+// such as WithHandshakeTimeout, apply to d if they come after it.
+func WithDialer(d *websocket.Dialer) Option {
+	return func(c *Client) {
+		c.dialer = d
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for wss connections.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.dialer.TLSClientConfig = cfg
+	}
+}
+
+// WithNetDial sets the function used to open TCP connections.
+func WithNetDial(dial func(network, addr string) (net.Conn, error)) Option {
+	return func(c *Client) {
+		c.dialer.NetDial = dial
+	}
+}
+
+// WithProxy tunnels connections through the HTTP proxy at proxyURL using
+// CONNECT. Credentials in proxyURL are sent with basic auth. Only http://
+// proxy URLs are supported; with any other scheme every dial fails. It wraps
+// the dial function configured so far, so it should come after WithNetDial.
+func WithProxy(proxyURL *url.URL) Option {
+	return func(c *Client) {
+		forward := c.dialer.NetDial
+		if forward == nil {
+			forward = (&net.Dialer{Timeout: c.dialer.HandshakeTimeout}).Dial
+		}
+		c.dialer.NetDial = proxyDial(proxyURL, forward)
+	}
+}
+
+// WithLongPollFallback makes the client fall back to long polling after
+// failures consecutive websocket connections fail before the server answers
+// anything. Long polling is used until it fails as many times in a row, then
+// websockets are tried again. Dialer options such as WithProxy and
+// WithTLSConfig apply to both.
+func WithLongPollFallback(failures int) Option {
+	return func(c *Client) {
+		c.longPollFallback = true
+		c.fallbackAfter = failures
+	}
+}
+
+// WithTransports replaces the client's transports. They are tried in order,
+// moving on to the next after failures consecutive failed connections and
+// wrapping around after the last.
+func WithTransports(failures int, transports ...Transport) Option {
+	return func(c *Client) {
+		c.transports = transports
+		c.fallbackAfter = failures
+	}
+}
+
+// WithHeader adds h to the headers of every handshake request.
+func WithHeader(h http.Header) Option {
+	return func(c *Client) {
+		for k, v := range h {
+			c.header[k] = append(c.header[k], v...)
+		}
+	}
+}
+
+// WithLogger sets the logger for connection and protocol messages. The
+// default discards them; see NewStdLogger.
+func WithLogger(l Logger) Option {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+// WithInboundQueue sets the capacity of the queues that buffer inbound events
+// for channel handlers and for the raw event channel, and what to do when one
+// is full. The default is 64 events with DropOldest. Sizes below 1 are
+// treated as 1.
+func WithInboundQueue(size int, policy OverflowPolicy) Option {
+	return func(c *Client) {
+		if size < 1 {
+			size = 1
+		}
+		c.inboundQueueSize = size
+		c.overflowPolicy = policy
+	}
+}
+
+// WithOutboundQueue sets how many pushes may wait for a reply at once,
+// including those queued while offline, and how long each may wait before
+// Push gives up. A zero timeout leaves it to the caller's context. The
+// defaults are 64 pushes and one minute.
+func WithOutboundQueue(size int, timeout time.Duration) Option {
+	return func(c *Client) {
+		c.outbox.size = size
+		c.pushTimeout = timeout
+	}
+}
+
+// WithReplay enables replay of events missed while disconnected. If cfg.Store
+// fails to load, the client starts without saved cursors. Replay stays off if
+// cfg has no Cursor or JoinParam.
+func WithReplay(cfg ReplayConfig) Option {
+	return func(c *Client) {
+		c.replayConfig = &cfg
+	}
+}
+
+// setQueryParam returns rawurl with the query parameter key set to value.
+// rawurl is returned unchanged if it cannot be parsed; dialing it will fail
+// with a more useful error.
+func setQueryParam(rawurl, key, value string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	if u.Path == "" {
+		// The websocket dialer rejects URLs without a path.
+		u.Path = "/"
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,225 @@
+package phoenix
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+const (
+	defaultOutboundQueueSize = 64
+	defaultPushTimeout       = time.Minute
+)
+
+type pushRequest struct {
+	event  Event
+	replyc chan replyOrError
+	// sent is set while the request is written on the current connection
+	// and awaiting its reply.
+	sent bool
+}
+
+type replyOrError struct {
+	reply *Reply
+	err   error
+}
+
+// outbox holds pushes from the moment they are made until the server replies,
+// including while the client is offline. Requests stay in push order.
+type outbox struct {
+	mu     sync.Mutex
+	size   int
+	reqs   []*pushRequest
+	closed bool
+}
+
+func (o *outbox) add(req *pushRequest) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return ErrClosed
+	}
+	if o.size > 0 && len(o.reqs) >= o.size {
+		return ErrQueueFull
+	}
+	o.reqs = append(o.reqs, req)
+	return nil
+}
+
+// remove takes the request with ref out of the outbox and returns it, or nil
+// if there is none.
+func (o *outbox) remove(ref string) *pushRequest {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, req := range o.reqs {
+		if req.event.Ref == ref {
+			o.reqs = append(o.reqs[:i], o.reqs[i+1:]...)
+			return req
+		}
+	}
+	return nil
+}
+
+// unsent returns the requests not yet written on the current connection.
+func (o *outbox) unsent() []*pushRequest {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var reqs []*pushRequest
+	for _, req := range o.reqs {
+		if !req.sent {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+func (o *outbox) markSent(req *pushRequest, sent bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	req.sent = sent
+}
+
+// requeue marks every request unsent after the connection drops, so requests
+// that never got a reply are sent again after reconnecting.
+func (o *outbox) requeue() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, req := range o.reqs {
+		req.sent = false
+	}
+}
+
+// requeueTopic marks the requests to topic unsent when the topic is joined
+// again. Replies to them from the earlier join are discarded as stale, so they
+// are sent again once the new join succeeds.
+func (o *outbox) requeueTopic(topic string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, req := range o.reqs {
+		if req.event.Topic == topic {
+			req.sent = false
+		}
+	}
+}
+
+// clear drops every request and refuses new ones.
+func (o *outbox) clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reqs = nil
+	o.closed = true
+}
+
+// Push sends event with payload to topic and waits for the matching phx_reply.
+// While the client is offline, or the topic is subscribed but not yet joined,
+// the push is queued and sent once it can be. A push whose reply is lost to a
+// disconnect or a rejoin of its topic is sent again after the topic is joined,
+// so the server may see it more than once. A push whose payload cannot be
+// encoded fails with the encoding error. Push gives up when ctx is done or the
+// push timeout elapses.
+func (c *Client) Push(ctx context.Context, topic, event string, payload []byte) (*Reply, error) {
+	return c.push(ctx, Event{
+		Topic:   topic,
+		Event:   event,
+		Payload: payload,
+	})
+}
+
+// PushBinary is like Push, but sends payload as raw bytes in a binary frame.
+// It requires a serializer with a binary format, such as V2Serializer.
+func (c *Client) PushBinary(ctx context.Context, topic, event string, payload []byte) (*Reply, error) {
+	if _, ok := c.serializer.(BinarySerializer); !ok {
+		return nil, ErrBinaryUnsupported
+	}
+	return c.push(ctx, Event{
+		Topic:   topic,
+		Event:   event,
+		Payload: payload,
+		Binary:  true,
+	})
+}
+
+func (c *Client) push(ctx context.Context, evt Event) (*Reply, error) {
+	if c.pushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.pushTimeout)
+		defer cancel()
+	}
+
+	evt.Ref = c.makeRef()
+	req := &pushRequest{
+		event:  evt,
+		replyc: make(chan replyOrError, 1),
+	}
+	if err := c.outbox.add(req); err != nil {
+		return nil, err
+	}
+	select {
+	case c.outboxKickc <- struct{}{}:
+	default:
+	}
+
+	select {
+	case res := <-req.replyc:
+		return res.reply, res.err
+	case <-ctx.Done():
+		c.outbox.remove(req.event.Ref)
+		return nil, ctx.Err()
+	case <-c.donec:
+		return nil, ErrClosed
+	}
+}
+
+// flushOutbox writes every queued push whose topic can take it now: either
+// the topic is joined, or it is not one of the client's subscriptions.
+func (c *Client) flushOutbox(conn TransportConn) error {
+	for _, req := range c.outbox.unsent() {
+		if !c.canPush(req.event.Topic) {
+			continue
+		}
+		// Stamp the current join ref, not the one from an earlier send.
+		req.event.JoinRef = ""
+		data, binary, err := c.encodeEvent(&req.event)
+		if err != nil {
+			// Sending it again won't help; fail the push instead.
+			c.outbox.remove(req.event.Ref)
+			req.replyc <- replyOrError{err: err}
+			continue
+		}
+		c.outbox.markSent(req, true)
+		err = conn.WriteMessage(data, binary)
+		if err == ErrBinaryUnsupported {
+			// The transport cannot carry it, e.g. long polling.
+			c.outbox.remove(req.event.Ref)
+			req.replyc <- replyOrError{err: err}
+			continue
+		}
+		if err != nil {
+			c.outbox.markSent(req, false)
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) handleReply(evt *Event) {
+	req := c.outbox.remove(evt.Ref)
+	if req == nil {
+		return
+	}
+
+	payload, err := decodeReply(evt)
+	if err != nil {
+		req.replyc <- replyOrError{err: fmt.Errorf("unmarshaling phx_reply payload: %s", err)}
+		return
+	}
+	req.replyc <- replyOrError{reply: &Reply{
+		Topic:    evt.Topic,
+		Ref:      evt.Ref,
+		Status:   payload.Status,
+		Response: payload.Response,
+		Binary:   evt.Binary,
+	}}
+}
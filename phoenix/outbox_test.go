@@ -0,0 +1,121 @@
+package phoenix_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// echo answers every push with its own payload.
+func echo(evt phoenix.Event) phoenixtest.Reply {
+	var body interface{}
+	json.Unmarshal(evt.Payload, &body)
+	return phoenixtest.Reply{Status: "ok", Response: map[string]interface{}{"echo": body}}
+}
+
+func TestPushReply(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	s.SetPushHandler(echo)
+	c := startClient(s)
+	defer c.Close()
+
+	// concurrent pushes each get the reply to their own ref
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+			defer cancel()
+			reply, err := c.Push(ctx, testTopic, "new_msg", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+			if err != nil {
+				t.Errorf("push %d: %s", i, err)
+				return
+			}
+			if !reply.OK() || reply.Topic != testTopic || reply.Ref == "" {
+				t.Errorf("push %d: reply %+v", i, reply)
+			}
+			if want := fmt.Sprintf(`{"echo":{"n":%d}}`, i); string(reply.Response) != want {
+				t.Errorf("push %d: response %s, want %s", i, reply.Response, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestPushErrorReply(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	s.SetPushHandler(func(phoenix.Event) phoenixtest.Reply {
+		return phoenixtest.Reply{Status: "error", Response: map[string]string{"reason": "invalid"}}
+	})
+	c := startClient(s)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	reply, err := c.Push(ctx, testTopic, "new_msg", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.OK() || reply.Status != "error" || string(reply.Response) != `{"reason":"invalid"}` {
+		t.Errorf("reply = %+v", reply)
+	}
+}
+
+func TestPushGivesUp(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := startClient(s, phoenix.WithOutboundQueue(1, 0))
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	s.Stall(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Push(ctx, testTopic, "new_msg", []byte(`{}`)); err != context.DeadlineExceeded {
+		t.Errorf("push to stalled server: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the push that gave up no longer takes room in the queue
+	s.Stall(false)
+	ctx, cancel = context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	if _, err := c.Push(ctx, testTopic, "new_msg", []byte(`{}`)); err != nil {
+		t.Errorf("push after giving up: %s", err)
+	}
+
+	c.Close()
+	if _, err := c.Push(context.Background(), testTopic, "new_msg", []byte(`{}`)); err != phoenix.ErrClosed {
+		t.Errorf("push after Close: %v, want %v", err, phoenix.ErrClosed)
+	}
+}
+
+func TestPushUnencodablePayload(t *testing.T) {
+	for _, ser := range []phoenix.Serializer{phoenix.V1Serializer{}, phoenix.V2Serializer{}} {
+		s := phoenixtest.NewServer()
+		c := startClient(s, phoenix.WithSerializer(ser))
+		waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+		ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+		if _, err := c.Push(ctx, testTopic, "new_msg", []byte("not json")); err == nil || err == context.DeadlineExceeded {
+			t.Errorf("%s: push of invalid JSON: %v, want an encoding error", ser.Vsn(), err)
+		}
+		// the connection and the pushes behind it are unaffected
+		if _, err := c.Push(ctx, testTopic, "new_msg", []byte(`{}`)); err != nil {
+			t.Errorf("%s: push after invalid JSON: %s", ser.Vsn(), err)
+		}
+		if n := c.Status().Reconnects; n != 0 {
+			t.Errorf("%s: %d reconnects", ser.Vsn(), n)
+		}
+		cancel()
+		c.Close()
+		s.Close()
+	}
+}
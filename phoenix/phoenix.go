@@ -2,101 +2,304 @@ package phoenix
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/gorilla/websocket"
 	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/jpillora/backoff"
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var (
+	// ErrClosed is returned by Push when the client is closed before the
+	// server replies.
+	ErrClosed = errors.New("phoenix: client closed")
+	// ErrQueueFull is returned by Push when the outbound queue is full.
+	ErrQueueFull = errors.New("phoenix: outbound queue full")
+	// ErrBinaryUnsupported is returned by PushBinary when the client's
+	// serializer has no binary format.
+	ErrBinaryUnsupported = errors.New("phoenix: serializer does not support binary messages")
 )
 
 type Client struct {
+	// dropped is updated atomically, so it comes first to keep it 64-bit
+	// aligned on 32-bit platforms such as ARM.
+	dropped uint64
+
 	u                      string
 	dialer                 *websocket.Dialer
+	header                 http.Header
+	reconnectBackoff       backoff.Backoff
+	logger                 Logger
 	heartbeatInterval      time.Duration
 	inactivityTimeout      time.Duration
 	inactivityTimeoutTimer *time.Timer
+	maxMissedHeartbeats    int
+	heartbeatLatency       latencyHistogram
+	// heartbeatsSent maps the refs of unanswered heartbeats on the current
+	// connection to when they were sent.
+	heartbeatsSent map[string]time.Time
+	serializer     Serializer
+	compress       bool
+
+	// transports are tried in order, moving on to the next after
+	// fallbackAfter consecutive failed connections.
+	transports       []Transport
+	fallbackAfter    int
+	longPollFallback bool
+
+	joinErrorFunc func(*JoinError)
+	// replayConfig is set by WithReplay, and replay is set up from it once
+	// every option is applied.
+	replayConfig *ReplayConfig
+	replay       *replayTracker
+
+	// credentialsRejected is set when the server refuses the credentials
+	// from credentialsFunc. It is only touched from the connection goroutine.
+	credentialsFunc     CredentialsFunc
+	credentialsRejected bool
+
+	// topics lists the subscribed topics in the order they were joined.
+	topicsMu    sync.Mutex
+	topics      []string
+	topicStates map[string]*topicState
+	topicsKickc chan struct{}
 
-	topics           []string
-	topicJoinPayload []byte
+	// rejoinc, connDone and joinedTopics belong to the current connection
+	// and are only touched from the connection goroutine.
+	rejoinc      chan string
+	connDone     chan struct{}
+	joinedTopics []string
 
-	inboundc chan *Event
+	channelsMu sync.Mutex
+	channels   map[string]*Channel
+
+	inboundc         chan *Event
+	dispatchc        chan *Event
+	inboundQueueSize int
+	overflowPolicy   OverflowPolicy
+
+	outbox      outbox
+	outboxKickc chan struct{}
+	pushTimeout time.Duration
+
+	status statusTracker
+
+	// stopping is the Done channel of the context passed to Run, and donec is
+	// closed when Run returns.
+	stopping <-chan struct{}
+	donec    chan struct{}
 
 	mu     sync.Mutex
-	closed bool
-	donec  chan struct{}
+	cancel context.CancelFunc
 	waitc  chan struct{}
 	ref    int
 }
 
-func InitClient(url string, topics []string, topicJoinPayload []byte) *Client {
-	return &Client{
+func InitClient(url string, topics []string, topicJoinPayload []byte, opts ...Option) *Client {
+	c := &Client{
 		u: url,
 		dialer: &websocket.Dialer{
 			HandshakeTimeout: 10 * time.Second,
 		},
-		heartbeatInterval: 30 * time.Second,
-		inactivityTimeout: time.Minute,
+		header: make(http.Header),
+		reconnectBackoff: backoff.Backoff{
+			Min:    100 * time.Millisecond,
+			Max:    10 * time.Second,
+			Factor: 2,
+			Jitter: true,
+		},
+		logger:              nopLogger{},
+		heartbeatInterval:   30 * time.Second,
+		inactivityTimeout:   time.Minute,
+		maxMissedHeartbeats: defaultMaxMissedHeartbeats,
+		serializer:          V1Serializer{},
+		inboundQueueSize:    defaultInboundQueueSize,
+		overflowPolicy:      DropOldest,
+
+		topicStates: make(map[string]*topicState),
+		topicsKickc: make(chan struct{}, 1),
+		channels:    make(map[string]*Channel),
+
+		outbox:      outbox{size: defaultOutboundQueueSize},
+		outboxKickc: make(chan struct{}, 1),
+		pushTimeout: defaultPushTimeout,
+		donec:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.replayConfig != nil {
+		c.initReplay(*c.replayConfig)
+	}
+	c.inboundc = make(chan *Event, c.inboundQueueSize)
+	c.dispatchc = make(chan *Event, c.inboundQueueSize)
+	c.u = setQueryParam(c.u, "vsn", c.serializer.Vsn())
+	if c.transports == nil {
+		c.transports = []Transport{&WebSocketTransport{Dialer: c.dialer, Compression: c.compress}}
+		if c.longPollFallback {
+			c.transports = append(c.transports, c.longPollTransport())
+		}
+	}
+	for _, topic := range topics {
+		c.Join(topic, topicJoinPayload)
+	}
+	return c
+}
+
+// Events returns the channel of inbound events that have no channel handler.
+// It is closed when Run returns.
+func (c *Client) Events() <-chan *Event {
+	return c.inboundc
+}
+
+// Run connects to the server and keeps the connection, its topics and its
+// heartbeats alive until ctx is done, reconnecting as needed. Before
+// returning it leaves every joined topic, closes the socket with a close
+// frame and waits for all of the client's goroutines, including running
+// channel handlers, to exit. It returns ctx.Err() once ctx is done. Run must
+// be called at most once per client.
+func (c *Client) Run(ctx context.Context) error {
+	c.stopping = ctx.Done()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.dispatchLoop()
+	}()
+
+	err := c.connLoop(ctx)
 
-		topics:           topics,
-		topicJoinPayload: topicJoinPayload,
+	close(c.donec)
+	c.outbox.clear()
+	if c.replay != nil {
+		if err := c.replay.flush(); err != nil {
+			c.logger.Log(LevelWarn, "saving replay cursors", Field{"error", err})
+		}
 	}
+	wg.Wait()
+	close(c.inboundc)
+	c.setState(StateClosed)
+	return err
 }
 
+// Start runs the client in the background and returns its inbound event
+// channel. Use Close to stop it.
 func (c *Client) Start() (inboundEventCh <-chan *Event) {
-	c.donec = make(chan struct{})
-	c.waitc = make(chan struct{})
-	c.inboundc = make(chan *Event)
+	ctx, cancel := context.WithCancel(context.Background())
+	waitc := make(chan struct{})
+
+	c.mu.Lock()
+	c.cancel = cancel
+	c.waitc = waitc
+	c.mu.Unlock()
 
-	go c.connLoop()
+	go func() {
+		c.Run(ctx)
+		close(waitc)
+	}()
 	return c.inboundc
 }
 
+// Close stops a client started with Start and waits for it to shut down.
 func (c *Client) Close() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.donec != nil && !c.closed {
-		close(c.donec)
-		<-c.waitc
-		c.closed = true
+	cancel, waitc := c.cancel, c.waitc
+	c.mu.Unlock()
+	if cancel == nil {
+		return
 	}
+	cancel()
+	<-waitc
 }
 
-func (c *Client) connLoop() {
-	b := backoff.Backoff{
-		Min:    100 * time.Millisecond,
-		Max:    10 * time.Second,
-		Factor: 2,
-		Jitter: true,
-	}
+// connLoop reconnects with backoff until ctx is done. A connection that
+// ends before the server sent anything counts as failed; after fallbackAfter
+// failures in a row the next transport is tried.
+func (c *Client) connLoop(ctx context.Context) error {
+	b := c.reconnectBackoff
+	cur, failures := 0, 0
+	// attempt counts the connection attempts since the last one that worked.
+	attempt := 0
 	for {
-		err := c.connOnce(c.u, b.Reset)
+		attempt++
+		transport := c.transports[cur]
+		c.setState(StateConnecting)
+		c.logger.Log(LevelDebug, "connecting", Field{"transport", transport.Name()}, Field{"attempt", attempt})
+		ok, err := c.connOnce(ctx, transport, attempt, b.Reset)
+		c.setState(StateDisconnected)
+		if isUnauthorized(err) && c.credentialsFunc != nil {
+			c.credentialsRejected = true
+		}
 		if err != nil {
-			log.Printf("conn error: %s", err)
+			c.logger.Log(LevelWarn, "disconnected", Field{"transport", transport.Name()}, Field{"attempt", attempt}, Field{"error", err})
+		} else {
+			c.logger.Log(LevelInfo, "disconnected", Field{"transport", transport.Name()}, Field{"attempt", attempt})
 		}
-		log.Println("disconnected")
+
+		if ok {
+			failures = 0
+			attempt = 0
+		} else {
+			failures++
+		}
+		if len(c.transports) > 1 && failures >= c.fallbackAfter {
+			cur = (cur + 1) % len(c.transports)
+			failures = 0
+			c.logger.Log(LevelWarn, "switching transport", Field{"from", transport.Name()}, Field{"to", c.transports[cur].Name()})
+		}
+
+		delay := b.Duration()
+		t := time.NewTimer(delay)
 		select {
-		case <-c.donec:
-			close(c.inboundc)
-			close(c.waitc)
-			return
-			// TODO: backoff
-		case <-time.After(b.Duration()):
-			log.Println("reconnecting")
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+			c.logger.Log(LevelDebug, "reconnecting", Field{"delay", delay})
 		}
 	}
 }
 
-func (c *Client) connOnce(url string, f func()) error {
-	// per docs, this resp.Body doesn't need to be closed
-	conn, _, err := c.dialer.Dial(c.u, nil)
+// connOnce connects with t and runs the connection until it fails or ctx is
+// done. ok reports whether the server sent anything on it.
+func (c *Client) connOnce(ctx context.Context, t Transport, attempt int, f func()) (ok bool, err error) {
+	rawurl, err := c.dialURL()
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer conn.Close()
-	fmt.Printf("connected to %s\n", conn.RemoteAddr())
+	conn, err := t.Dial(rawurl, c.header)
+	if err != nil {
+		return false, redactURL(err)
+	}
+
+	c.rejoinc = make(chan string)
+	c.connDone = make(chan struct{})
+	c.joinedTopics = nil
+	recvc := make(chan eventOrError)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		c.readLoop(conn, recvc, c.connDone)
+	}()
+	defer func() {
+		c.closeTopics()
+		close(c.connDone)
+		conn.Close()
+		<-readerDone
+		c.outbox.requeue()
+	}()
+
+	c.setState(StateConnected)
+	c.logger.Log(LevelInfo, "connected",
+		Field{"remote_addr", conn.RemoteAddr()},
+		Field{"transport", t.Name()},
+		Field{"attempt", attempt})
 	if f != nil {
 		f()
 	}
@@ -104,42 +307,73 @@ func (c *Client) connOnce(url string, f func()) error {
 	c.inactivityTimeoutTimer = time.NewTimer(c.inactivityTimeout)
 	defer c.inactivityTimeoutTimer.Stop()
 
+	c.heartbeatsSent = make(map[string]time.Time)
 	hbTick := time.NewTicker(c.heartbeatInterval)
 	defer hbTick.Stop()
 
-	for _, topic := range c.topics {
-		joinMsg := Event{
-			Topic:   topic,
-			Event:   "phx_join",
-			Payload: c.topicJoinPayload,
-			Ref:     c.makeRef(),
-		}
-		if err = conn.WriteJSON(&joinMsg); err != nil {
-			return err
-		}
+	if err = c.syncTopics(conn); err != nil {
+		return false, err
 	}
 
-	recvc := make(chan eventOrError, 1)
-	go c.receiveMsg(conn, recvc)
-
 	for {
+		if err = c.afterJoin(conn); err != nil {
+			return ok, err
+		}
+		if err = c.flushOutbox(conn); err != nil {
+			return ok, err
+		}
+		c.refreshJoined()
 		select {
-		case <-c.donec:
-			conn.Close()
-			return nil
+		case <-ctx.Done():
+			c.shutdown(conn, recvc)
+			return ok, nil
 		case eventOrErr := <-recvc:
 			if eventOrErr.err != nil {
-				return err
+				return ok, eventOrErr.err
 			}
-
+			ok = true
 			c.handleEvent(eventOrErr.event)
-			go c.receiveMsg(conn, recvc)
+		case <-c.outboxKickc:
+		case topic := <-c.rejoinc:
+			if err = c.sendJoin(conn, topic); err != nil {
+				return ok, err
+			}
+		case <-c.topicsKickc:
+			if err = c.syncTopics(conn); err != nil {
+				return ok, err
+			}
 		case <-hbTick.C:
 			if err = c.sendHeartbeat(conn); err != nil {
-				return err
+				return ok, err
 			}
 		case <-c.inactivityTimeoutTimer.C:
-			return fmt.Errorf("timeout waiting for heartbeat")
+			return ok, fmt.Errorf("timeout waiting for heartbeat")
+		}
+	}
+}
+
+// shutdown leaves every joined topic and closes conn with a close frame,
+// giving the server a moment to acknowledge before the socket is torn down.
+func (c *Client) shutdown(conn TransportConn, recvc <-chan eventOrError) {
+	if err := c.leaveTopics(conn); err != nil {
+		c.logger.Log(LevelWarn, "leaving topics", Field{"error", err})
+		return
+	}
+	if err := conn.Shutdown(); err != nil {
+		c.logger.Log(LevelWarn, "closing connection", Field{"error", err})
+		return
+	}
+
+	t := time.NewTimer(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case eventOrErr := <-recvc:
+			if eventOrErr.err != nil {
+				return
+			}
+		case <-t.C:
+			return
 		}
 	}
 }
@@ -147,17 +381,29 @@ func (c *Client) connOnce(url string, f func()) error {
 func (c *Client) handleEvent(evt *Event) {
 	// If we've received any kind of event, the channel must be alive.
 	c.inactivityTimeoutTimer.Reset(c.inactivityTimeout)
+	c.logger.Log(LevelDebug, "received", append(eventFields(evt), payloadField(evt))...)
+	if c.isStale(evt) {
+		c.logger.Log(LevelDebug, "discarding message from stale join", eventFields(evt)...)
+		return
+	}
 	switch evt.Event {
 	case "phx_reply":
-		payload := PhxReplyPayload{}
-		if err := json.Unmarshal(evt.Payload, &payload); err != nil {
-			log.Println("unmarshaling phx_reply payload:", err)
+		if evt.Topic == "phoenix" {
+			c.handleHeartbeatReply(evt)
+		} else if !c.handleJoinReply(evt) {
+			c.handleReply(evt)
 		}
+	case "phx_error", "phx_close":
+		c.handleTopicClosed(evt)
 	default:
-		select {
-		case c.inboundc <- evt:
-		default:
-			log.Printf("no receiver ready, dropping message: %#v\n", evt)
+		cursor, dup := c.replayCheck(evt)
+		if dup {
+			c.logger.Log(LevelDebug, "dropping replayed duplicate", eventFields(evt)...)
+			return
+		}
+		// an event dropped for lack of room is left to be replayed
+		if c.deliver(evt) {
+			c.replayCommit(evt.Topic, cursor)
 		}
 	}
 }
@@ -175,24 +421,73 @@ func (c *Client) makeRef() string {
 	return strconv.Itoa(newRef)
 }
 
-func (c *Client) receiveMsg(conn *websocket.Conn, recvc chan<- eventOrError) {
-	event := &Event{}
-	if err := conn.ReadJSON(event); err != nil {
-		recvc <- eventOrError{err: err}
-		close(recvc)
-		return
+// readLoop decodes messages from conn onto recvc until reading fails or done
+// is closed.
+func (c *Client) readLoop(conn TransportConn, recvc chan<- eventOrError, done <-chan struct{}) {
+	for {
+		var res eventOrError
+		data, binary, err := conn.ReadMessage()
+		if err != nil {
+			res.err = err
+		} else {
+			event := &Event{}
+			if err := c.decode(data, binary, event); err != nil {
+				res.err = fmt.Errorf("decoding message: %s", err)
+			} else {
+				res.event = event
+			}
+		}
+
+		select {
+		case recvc <- res:
+		case <-done:
+			return
+		}
+		if res.err != nil {
+			return
+		}
+	}
+}
+
+// decode decodes a text or binary message with the client's serializer.
+func (c *Client) decode(data []byte, binary bool, evt *Event) error {
+	if !binary {
+		return c.serializer.Decode(data, evt)
+	}
+	bs, ok := c.serializer.(BinarySerializer)
+	if !ok {
+		return ErrBinaryUnsupported
+	}
+	return bs.DecodeBinary(data, evt)
+}
+
+// writeEvent encodes evt and writes it to conn.
+func (c *Client) writeEvent(conn TransportConn, evt *Event) error {
+	data, binary, err := c.encodeEvent(evt)
+	if err != nil {
+		return err
 	}
-	recvc <- eventOrError{event: event}
+	return conn.WriteMessage(data, binary)
 }
 
-func (c *Client) sendHeartbeat(conn *websocket.Conn) error {
-	hbMsg := Event{
-		Topic:   "phoenix",
-		Event:   "heartbeat",
-		Payload: []byte("{}"),
-		Ref:     c.makeRef(),
+// encodeEvent encodes evt with the client's serializer, in binary form if
+// evt.Binary is set. Messages for a joined topic are stamped with the topic's
+// current join ref.
+func (c *Client) encodeEvent(evt *Event) (data []byte, binary bool, err error) {
+	if evt.JoinRef == "" {
+		evt.JoinRef = c.joinRef(evt.Topic)
 	}
-	return conn.WriteJSON(&hbMsg)
+	c.logger.Log(LevelDebug, "sending", append(eventFields(evt), payloadField(evt))...)
+	if evt.Binary {
+		bs, ok := c.serializer.(BinarySerializer)
+		if !ok {
+			return nil, false, ErrBinaryUnsupported
+		}
+		data, err = bs.EncodeBinary(evt)
+		return data, true, err
+	}
+	data, err = c.serializer.Encode(evt)
+	return data, false, err
 }
 
 type eventOrError struct {
@@ -205,6 +500,16 @@ type Event struct {
 	Event   string          `json:"event"`
 	Payload json.RawMessage `json:"payload"`
 	Ref     string          `json:"ref"`
+	// JoinRef is the ref of the phx_join the message belongs to. It is only
+	// carried by protocol version 2.
+	JoinRef string `json:"join_ref,omitempty"`
+	// Binary reports that the message travels in a binary frame and Payload
+	// holds raw bytes rather than JSON.
+	Binary bool `json:"-"`
+
+	// status is the status of a binary phx_reply, which has no JSON payload
+	// to carry it.
+	status string
 }
 
 type PhxReplyPayload struct {
@@ -212,4 +517,44 @@ type PhxReplyPayload struct {
 	Response map[string]interface{} `json:"response"`
 }
 
+type replyPayload struct {
+	Status   string          `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+// decodeReply returns the status and response of the phx_reply evt.
+func decodeReply(evt *Event) (replyPayload, error) {
+	if evt.Binary {
+		return replyPayload{Status: evt.status, Response: evt.Payload}, nil
+	}
+	payload := replyPayload{}
+	err := json.Unmarshal(evt.Payload, &payload)
+	return payload, err
+}
+
+// Reply is the server's phx_reply to a pushed message.
+type Reply struct {
+	Topic    string
+	Ref      string
+	Status   string
+	Response json.RawMessage
+	// Binary reports that Response holds the raw bytes of a binary reply
+	// rather than JSON.
+	Binary bool
+}
+
+// OK reports whether the server replied with an "ok" status.
+func (r *Reply) OK() bool {
+	return r.Status == "ok"
+}
+
+// PushError reports a push that the server answered with a non-ok status.
+type PushError struct {
+	Reply *Reply
+}
+
+func (e *PushError) Error() string {
+	return fmt.Sprintf("phoenix: push to %s: status %s", e.Reply.Topic, e.Reply.Status)
+}
+
 type TopicJoinFunc func(topic string) (payload string)
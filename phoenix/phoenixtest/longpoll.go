@@ -0,0 +1,190 @@
+package phoenixtest
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/gorilla/websocket"
+	"github.com/opendoor-labs/gong/phoenix"
+)
+
+// pollWindow is how long a poll waits for messages before returning empty,
+// and how long a session survives without being polled, as in Phoenix.
+const pollWindow = 10 * time.Second
+
+// pollSession holds the messages for a long-poll client until it next polls.
+type pollSession struct {
+	token string
+	// wrap reports whether messages are sent as JSON strings, as protocol
+	// version 2 does, rather than embedded objects.
+	wrap bool
+
+	mu     sync.Mutex
+	msgs   []json.RawMessage
+	closed bool
+	// wakec is closed and replaced whenever msgs or closed change.
+	wakec  chan struct{}
+	expiry *time.Timer
+}
+
+func (p *pollSession) push(msgType int, data []byte) error {
+	if msgType == websocket.BinaryMessage {
+		return errors.New("phoenixtest: long polling does not carry binary messages")
+	}
+	msg := json.RawMessage(data)
+	if p.wrap {
+		var err error
+		if msg, err = json.Marshal(string(data)); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("phoenixtest: long poll session closed")
+	}
+	p.msgs = append(p.msgs, msg)
+	p.wakeLocked()
+	return nil
+}
+
+func (p *pollSession) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.wakeLocked()
+}
+
+func (p *pollSession) wakeLocked() {
+	close(p.wakec)
+	p.wakec = make(chan struct{})
+}
+
+// wait returns the queued messages, waiting up to pollWindow for some to
+// arrive. It gives up early if the client goes away, and reports false if
+// the session is closed.
+func (p *pollSession) wait(gone <-chan bool) ([]json.RawMessage, bool) {
+	t := time.NewTimer(pollWindow)
+	defer t.Stop()
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, false
+		}
+		if len(p.msgs) > 0 {
+			msgs := p.msgs
+			p.msgs = nil
+			p.mu.Unlock()
+			return msgs, true
+		}
+		wakec := p.wakec
+		p.mu.Unlock()
+
+		select {
+		case <-wakec:
+		case <-gone:
+			return nil, true
+		case <-t.C:
+			return nil, true
+		}
+	}
+}
+
+type pollResponse struct {
+	Status   int               `json:"status"`
+	Token    string            `json:"token,omitempty"`
+	Messages []json.RawMessage `json:"messages,omitempty"`
+}
+
+// serveLongPoll serves the longpoll endpoint. A request without a valid
+// token is answered with status 410 and the token of a new session; polls
+// return the session's queued messages and posts deliver one message.
+func (s *Server) serveLongPoll(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	sc := s.sessions[r.URL.Query().Get("token")]
+	s.mu.Unlock()
+	if sc == nil {
+		if r.Method != "GET" {
+			writePollResponse(w, pollResponse{Status: http.StatusGone})
+			return
+		}
+		sc = s.newPollSession(r)
+		writePollResponse(w, pollResponse{Status: http.StatusGone, Token: sc.poll.token})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		sc.poll.expiry.Stop()
+		var gone <-chan bool
+		if cn, ok := w.(http.CloseNotifier); ok {
+			gone = cn.CloseNotify()
+		}
+		msgs, ok := sc.poll.wait(gone)
+		sc.poll.expiry.Reset(pollWindow)
+		switch {
+		case !ok:
+			writePollResponse(w, pollResponse{Status: http.StatusGone})
+		case len(msgs) == 0:
+			writePollResponse(w, pollResponse{Status: http.StatusNoContent, Token: sc.poll.token})
+		default:
+			writePollResponse(w, pollResponse{Status: http.StatusOK, Token: sc.poll.token, Messages: msgs})
+		}
+	case "POST":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		evt := phoenix.Event{}
+		if err := sc.serializer.Decode(data, &evt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.handle(sc, &evt)
+		writePollResponse(w, pollResponse{Status: http.StatusOK})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) newPollSession(r *http.Request) *serverConn {
+	serializer := serializerFor(r.URL.Query().Get("vsn"))
+	_, wrap := serializer.(phoenix.V2Serializer)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastToken++
+	sc := &serverConn{
+		poll: &pollSession{
+			token: strconv.Itoa(s.lastToken),
+			wrap:  wrap,
+			wakec: make(chan struct{}),
+		},
+		serializer: serializer,
+		joined:     make(map[string]string),
+	}
+	sc.poll.expiry = time.AfterFunc(pollWindow, func() { s.expire(sc) })
+	s.sessions[sc.poll.token] = sc
+	s.conns[sc] = struct{}{}
+	return sc
+}
+
+// expire ends a session its client stopped polling.
+func (s *Server) expire(sc *serverConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc.poll.close()
+	delete(s.sessions, sc.poll.token)
+	delete(s.conns, sc)
+}
+
+func writePollResponse(w http.ResponseWriter, resp pollResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,472 @@
+// Package phoenixtest provides an in-process Phoenix channel server for
+// exercising phoenix.Client without a real backend.
+package phoenixtest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/gorilla/websocket"
+	"github.com/opendoor-labs/gong/phoenix"
+)
+
+// ErrTimeout is returned by WaitFor when no matching message arrives in time.
+var ErrTimeout = errors.New("phoenixtest: timed out waiting for message")
+
+// Reply is the status and response the server sends in a phx_reply. A
+// Response of type []byte is sent as a binary reply to connections speaking
+// protocol version 2.
+type Reply struct {
+	Status   string
+	Response interface{}
+}
+
+// OK is the reply the server sends when nothing else is configured.
+var OK = Reply{Status: "ok", Response: map[string]interface{}{}}
+
+// PushHandler decides the reply to a message pushed by a client.
+type PushHandler func(evt phoenix.Event) Reply
+
+// Server is a websocket and long-poll server speaking the Phoenix channel
+// protocol. It accepts joins, answers heartbeats and pushes, and lets tests
+// broadcast events and misbehave on demand. The protocol version is picked
+// per connection from the vsn query parameter.
+type Server struct {
+	// URL is the ws:// URL clients should dial.
+	URL string
+
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu              sync.Mutex
+	cond            *sync.Cond
+	conns           map[*serverConn]struct{}
+	joinReplies     map[string]Reply
+	pushHandler     PushHandler
+	handshakeStatus int
+	noWebSocket     bool
+	stalled         bool
+	sessions        map[string]*serverConn
+	lastToken       int
+	received        []phoenix.Event
+	requests        []*http.Request
+}
+
+// serverConn is a websocket connection or a long-poll session.
+type serverConn struct {
+	ws         *websocket.Conn
+	poll       *pollSession
+	serializer phoenix.Serializer
+
+	writeMu sync.Mutex
+	// joined maps topics to the ref of the join that subscribed them. It is
+	// guarded by Server.mu.
+	joined map[string]string
+}
+
+// NewServer starts a server listening on a local port.
+func NewServer() *Server {
+	s := &Server{
+		conns:       make(map[*serverConn]struct{}),
+		joinReplies: make(map[string]Reply),
+		sessions:    make(map[string]*serverConn),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = "ws" + strings.TrimPrefix(s.srv.URL, "http") + "/socket/websocket"
+	return s
+}
+
+// Close drops every connection and shuts the server down.
+func (s *Server) Close() {
+	s.DropConnections()
+	s.srv.Close()
+}
+
+// SetJoinReply makes the server answer joins of topic with r instead of OK.
+func (s *Server) SetJoinReply(topic string, r Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.joinReplies[topic] = r
+}
+
+// SetPushHandler sets the handler deciding replies to client pushes. Without
+// one every push is answered with OK.
+func (s *Server) SetPushHandler(h PushHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushHandler = h
+}
+
+// SetHandshakeStatus makes the server refuse websocket handshakes with the
+// given HTTP status code. Zero accepts them again.
+func (s *Server) SetHandshakeStatus(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handshakeStatus = code
+}
+
+// DisableWebSocket makes the server drop websocket handshakes without a
+// response while disabled is true, as middleboxes that break websockets do.
+// Long polling keeps working.
+func (s *Server) DisableWebSocket(disabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noWebSocket = disabled
+}
+
+// Stall makes the server keep reading but stop answering anything, including
+// heartbeats, while stalled is true.
+func (s *Server) Stall(stalled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stalled = stalled
+}
+
+// DropConnections closes every open connection without a close frame, as a
+// network failure would, and ends every long-poll session.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sc := range s.conns {
+		if sc.ws != nil {
+			sc.ws.UnderlyingConn().Close()
+		} else {
+			sc.poll.close()
+			delete(s.sessions, sc.poll.token)
+		}
+		delete(s.conns, sc)
+	}
+}
+
+// ConnCount returns the number of open connections and long-poll sessions.
+func (s *Server) ConnCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Broadcast sends event with payload to every connection joined to topic and
+// returns how many received it.
+func (s *Server) Broadcast(topic, event string, payload interface{}) (int, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	type target struct {
+		sc      *serverConn
+		joinRef string
+	}
+	var targets []target
+	s.mu.Lock()
+	for sc := range s.conns {
+		if joinRef, ok := sc.joined[topic]; ok {
+			targets = append(targets, target{sc, joinRef})
+		}
+	}
+	s.mu.Unlock()
+
+	n := 0
+	for _, t := range targets {
+		evt := phoenix.Event{
+			Topic:   topic,
+			Event:   event,
+			Payload: data,
+			JoinRef: t.joinRef,
+		}
+		if err := t.sc.write(&evt); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// BroadcastBinary sends event with a raw payload in a binary frame to every
+// connection joined to topic and returns how many received it. Only
+// connections speaking protocol version 2 are sent to.
+func (s *Server) BroadcastBinary(topic, event string, payload []byte) (int, error) {
+	if len(topic) > 255 || len(event) > 255 {
+		return 0, errors.New("phoenixtest: topic or event longer than 255 bytes")
+	}
+	data := []byte{binaryBroadcast, byte(len(topic)), byte(len(event))}
+	data = append(data, topic...)
+	data = append(data, event...)
+	data = append(data, payload...)
+
+	var targets []*serverConn
+	s.mu.Lock()
+	for sc := range s.conns {
+		if _, ok := sc.joined[topic]; ok && sc.binary() {
+			targets = append(targets, sc)
+		}
+	}
+	s.mu.Unlock()
+
+	n := 0
+	for _, sc := range targets {
+		if err := sc.writeMessage(websocket.BinaryMessage, data); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Received returns every message received from clients so far.
+func (s *Server) Received() []phoenix.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]phoenix.Event(nil), s.received...)
+}
+
+// Requests returns the handshake requests received so far, including refused
+// ones.
+func (s *Server) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// WaitFor waits up to timeout for a received message satisfying match,
+// including ones received before the call, and returns the first one.
+func (s *Server) WaitFor(match func(phoenix.Event) bool, timeout time.Duration) (phoenix.Event, error) {
+	timedOut := false
+	t := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		timedOut = true
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer t.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; ; {
+		for ; i < len(s.received); i++ {
+			if match(s.received[i]) {
+				return s.received[i], nil
+			}
+		}
+		if timedOut {
+			return phoenix.Event{}, ErrTimeout
+		}
+		s.cond.Wait()
+	}
+}
+
+// WaitForEvent waits for a message with the given topic and event name.
+func (s *Server) WaitForEvent(topic, event string, timeout time.Duration) (phoenix.Event, error) {
+	return s.WaitFor(func(evt phoenix.Event) bool {
+		return evt.Topic == topic && evt.Event == event
+	}, timeout)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	status := s.handshakeStatus
+	noWebSocket := s.noWebSocket
+	s.mu.Unlock()
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/longpoll") {
+		s.serveLongPoll(w, r)
+		return
+	}
+	if noWebSocket {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	sc := &serverConn{
+		ws:         ws,
+		serializer: serializerFor(r.URL.Query().Get("vsn")),
+		joined:     make(map[string]string),
+	}
+	s.mu.Lock()
+	s.conns[sc] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, sc)
+		s.mu.Unlock()
+		ws.Close()
+	}()
+	for {
+		msgType, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		evt := phoenix.Event{}
+		if msgType == websocket.BinaryMessage && sc.binary() {
+			err = decodeBinaryPush(data, &evt)
+		} else {
+			err = sc.serializer.Decode(data, &evt)
+		}
+		if err != nil {
+			return
+		}
+		s.handle(sc, &evt)
+	}
+}
+
+func (s *Server) handle(sc *serverConn, evt *phoenix.Event) {
+	s.mu.Lock()
+	s.received = append(s.received, *evt)
+	s.cond.Broadcast()
+	stalled := s.stalled
+	joinReply, ok := s.joinReplies[evt.Topic]
+	if !ok {
+		joinReply = OK
+	}
+	pushHandler := s.pushHandler
+	s.mu.Unlock()
+	if stalled {
+		return
+	}
+
+	reply := OK
+	switch {
+	case evt.Topic == "phoenix" && evt.Event == "heartbeat":
+	case evt.Event == "phx_join":
+		reply = joinReply
+		if reply.Status == "ok" {
+			s.mu.Lock()
+			sc.joined[evt.Topic] = evt.Ref
+			s.mu.Unlock()
+		}
+	case evt.Event == "phx_leave":
+		s.mu.Lock()
+		delete(sc.joined, evt.Topic)
+		s.mu.Unlock()
+	case pushHandler != nil:
+		reply = pushHandler(*evt)
+	}
+	sc.reply(evt, reply)
+}
+
+func (sc *serverConn) reply(evt *phoenix.Event, r Reply) error {
+	if raw, ok := r.Response.([]byte); ok && sc.binary() {
+		data, err := encodeBinaryReply(evt, r.Status, raw)
+		if err != nil {
+			return err
+		}
+		return sc.writeMessage(websocket.BinaryMessage, data)
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"status":   r.Status,
+		"response": r.Response,
+	})
+	if err != nil {
+		return err
+	}
+	return sc.write(&phoenix.Event{
+		Topic:   evt.Topic,
+		Event:   "phx_reply",
+		Payload: payload,
+		Ref:     evt.Ref,
+		JoinRef: evt.JoinRef,
+	})
+}
+
+func (sc *serverConn) write(evt *phoenix.Event) error {
+	data, err := sc.serializer.Encode(evt)
+	if err != nil {
+		return err
+	}
+	return sc.writeMessage(websocket.TextMessage, data)
+}
+
+func (sc *serverConn) writeMessage(msgType int, data []byte) error {
+	if sc.poll != nil {
+		return sc.poll.push(msgType, data)
+	}
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return sc.ws.WriteMessage(msgType, data)
+}
+
+// binary reports whether the connection speaks a protocol version with
+// binary messages.
+func (sc *serverConn) binary() bool {
+	_, ok := sc.serializer.(phoenix.BinarySerializer)
+	return ok
+}
+
+// Message kinds of the Phoenix binary format.
+const (
+	binaryPush      = 0
+	binaryReply     = 1
+	binaryBroadcast = 2
+)
+
+// decodeBinaryPush decodes a binary push from a client: the kind byte, the
+// lengths of join_ref, ref, topic and event, those fields, then the payload.
+func decodeBinaryPush(data []byte, evt *phoenix.Event) error {
+	errShort := errors.New("phoenixtest: short binary message")
+	if len(data) < 5 {
+		return errShort
+	}
+	if data[0] != binaryPush {
+		return errors.New("phoenixtest: binary message is not a push")
+	}
+	var fields [4]string
+	off := 5
+	for i := range fields {
+		size := int(data[1+i])
+		if off+size > len(data) {
+			return errShort
+		}
+		fields[i] = string(data[off : off+size])
+		off += size
+	}
+	*evt = phoenix.Event{
+		JoinRef: fields[0],
+		Ref:     fields[1],
+		Topic:   fields[2],
+		Event:   fields[3],
+		Payload: data[off:],
+		Binary:  true,
+	}
+	return nil
+}
+
+// encodeBinaryReply encodes a binary reply to evt: the kind byte, the lengths
+// of join_ref, ref, topic and status, those fields, then the response.
+func encodeBinaryReply(evt *phoenix.Event, status string, response []byte) ([]byte, error) {
+	fields := []string{evt.JoinRef, evt.Ref, evt.Topic, status}
+	data := []byte{binaryReply}
+	for _, f := range fields {
+		if len(f) > 255 {
+			return nil, errors.New("phoenixtest: binary reply field longer than 255 bytes")
+		}
+		data = append(data, byte(len(f)))
+	}
+	for _, f := range fields {
+		data = append(data, f...)
+	}
+	return append(data, response...), nil
+}
+
+func serializerFor(vsn string) phoenix.Serializer {
+	if vsn == (phoenix.V2Serializer{}).Vsn() {
+		return phoenix.V2Serializer{}
+	}
+	return phoenix.V1Serializer{}
+}
@@ -0,0 +1,247 @@
+package phoenix
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+const defaultTrackEvent = "track"
+
+// Meta is one presence entry's metadata. The server adds a unique "phx_ref"
+// to every entry.
+type Meta map[string]interface{}
+
+func (m Meta) ref() string {
+	ref, _ := m["phx_ref"].(string)
+	return ref
+}
+
+// PresenceFunc is called when metas join or leave the presence under key.
+// current is the key's metas before a join or after a leave; it is empty
+// for a key seen for the first time or gone entirely.
+type PresenceFunc func(key string, current, changed []Meta)
+
+// Presence keeps the merged Phoenix Presence state of one channel from its
+// presence_state and presence_diff events, mirroring the Phoenix JS client.
+type Presence struct {
+	ch *Channel
+
+	mu         sync.Mutex
+	state      map[string][]Meta
+	onJoin     PresenceFunc
+	onLeave    PresenceFunc
+	trackEvent string
+	trackMeta  json.RawMessage
+}
+
+type presenceEntry struct {
+	Metas []Meta `json:"metas"`
+}
+
+type presenceDiff struct {
+	Joins  map[string]presenceEntry `json:"joins"`
+	Leaves map[string]presenceEntry `json:"leaves"`
+}
+
+// Presence returns the channel's presence tracker, creating it on first use.
+// It takes over the channel's presence_state and presence_diff handlers.
+func (ch *Channel) Presence() *Presence {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.presence != nil {
+		return ch.presence
+	}
+	p := &Presence{
+		ch:         ch,
+		state:      make(map[string][]Meta),
+		trackEvent: defaultTrackEvent,
+	}
+	ch.presence = p
+	ch.handlers["presence_state"] = p.handleState
+	ch.handlers["presence_diff"] = p.handleDiff
+	return p
+}
+
+// OnJoin registers f to be called for every join, including the first
+// appearance of a key. It runs on the client's dispatch goroutine.
+func (p *Presence) OnJoin(f PresenceFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onJoin = f
+}
+
+// OnLeave registers f to be called for every leave. It runs on the client's
+// dispatch goroutine.
+func (p *Presence) OnLeave(f PresenceFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onLeave = f
+}
+
+// List returns a copy of the current presence state by key.
+func (p *Presence) List() map[string][]Meta {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make(map[string][]Meta, len(p.state))
+	for key, metas := range p.state {
+		list[key] = append([]Meta(nil), metas...)
+	}
+	return list
+}
+
+// SetTrackEvent changes the event Track pushes. The default is "track"; the
+// server's channel must handle it by calling Presence.track.
+func (p *Presence) SetTrackEvent(event string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.trackEvent = event
+}
+
+// Track asks the server to track this client with meta. Presence does not
+// survive a rejoin on the server, so meta is sent again after every
+// successful join. If the topic is joined now, Track pushes immediately and
+// returns the server's verdict; otherwise it returns nil and meta goes out
+// with the next join.
+func (p *Presence) Track(ctx context.Context, meta interface{}) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.trackMeta = data
+	event := p.trackEvent
+	p.mu.Unlock()
+
+	if p.ch.State() != TopicJoined {
+		return nil
+	}
+	reply, err := p.ch.Push(ctx, event, data)
+	if err != nil {
+		return err
+	}
+	if !reply.OK() {
+		return &PushError{Reply: reply}
+	}
+	return nil
+}
+
+// trackMessage returns the message that re-tracks this client after a join,
+// or nil if Track was never called.
+func (p *Presence) trackMessage() *Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.trackMeta == nil {
+		return nil
+	}
+	return &Event{
+		Topic:   p.ch.topic,
+		Event:   p.trackEvent,
+		Payload: p.trackMeta,
+	}
+}
+
+func (p *Presence) handleState(evt *Event) {
+	newState := make(map[string]presenceEntry)
+	if err := json.Unmarshal(evt.Payload, &newState); err != nil {
+		p.ch.client.logger.Log(LevelWarn, "unmarshaling presence_state", Field{"topic", evt.Topic}, Field{"error", err})
+		return
+	}
+
+	p.mu.Lock()
+	diff := presenceDiff{
+		Joins:  make(map[string]presenceEntry),
+		Leaves: make(map[string]presenceEntry),
+	}
+	for key, metas := range p.state {
+		if _, ok := newState[key]; !ok {
+			diff.Leaves[key] = presenceEntry{Metas: metas}
+		}
+	}
+	for key, entry := range newState {
+		current, ok := p.state[key]
+		if !ok {
+			diff.Joins[key] = entry
+			continue
+		}
+		joined := metasNotIn(entry.Metas, current)
+		left := metasNotIn(current, entry.Metas)
+		if len(joined) > 0 {
+			diff.Joins[key] = presenceEntry{Metas: joined}
+		}
+		if len(left) > 0 {
+			diff.Leaves[key] = presenceEntry{Metas: left}
+		}
+	}
+	p.mu.Unlock()
+
+	p.apply(diff)
+}
+
+func (p *Presence) handleDiff(evt *Event) {
+	diff := presenceDiff{}
+	if err := json.Unmarshal(evt.Payload, &diff); err != nil {
+		p.ch.client.logger.Log(LevelWarn, "unmarshaling presence_diff", Field{"topic", evt.Topic}, Field{"error", err})
+		return
+	}
+	p.apply(diff)
+}
+
+// apply merges diff into the state and then runs the callbacks, outside the
+// lock so they may call List.
+func (p *Presence) apply(diff presenceDiff) {
+	type change struct {
+		key              string
+		current, changed []Meta
+	}
+	var joins, leaves []change
+
+	p.mu.Lock()
+	for key, entry := range diff.Joins {
+		current := p.state[key]
+		p.state[key] = append(metasNotIn(current, entry.Metas), entry.Metas...)
+		joins = append(joins, change{key, current, entry.Metas})
+	}
+	for key, entry := range diff.Leaves {
+		current, ok := p.state[key]
+		if !ok {
+			continue
+		}
+		remaining := metasNotIn(current, entry.Metas)
+		if len(remaining) == 0 {
+			delete(p.state, key)
+		} else {
+			p.state[key] = remaining
+		}
+		leaves = append(leaves, change{key, remaining, entry.Metas})
+	}
+	onJoin, onLeave := p.onJoin, p.onLeave
+	p.mu.Unlock()
+
+	if onJoin != nil {
+		for _, c := range joins {
+			onJoin(c.key, c.current, c.changed)
+		}
+	}
+	if onLeave != nil {
+		for _, c := range leaves {
+			onLeave(c.key, c.current, c.changed)
+		}
+	}
+}
+
+// metasNotIn returns the metas in a whose phx_ref does not appear in b.
+func metasNotIn(a, b []Meta) []Meta {
+	refs := make(map[string]bool, len(b))
+	for _, m := range b {
+		refs[m.ref()] = true
+	}
+	var out []Meta
+	for _, m := range a {
+		if !refs[m.ref()] {
+			out = append(out, m)
+		}
+	}
+	return out
+}
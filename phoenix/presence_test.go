@@ -0,0 +1,188 @@
+package phoenix_test
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// presenceCall is a presence callback call, with metas reduced to their
+// phx_refs.
+type presenceCall struct {
+	kind, key        string
+	current, changed string
+}
+
+func refs(metas []phoenix.Meta) string {
+	var rs []string
+	for _, m := range metas {
+		rs = append(rs, fmt.Sprint(m["phx_ref"]))
+	}
+	sort.Strings(rs)
+	return strings.Join(rs, ",")
+}
+
+// presenceEntry returns a presence entry with a meta for each of phxRefs.
+func presenceEntry(phxRefs ...string) map[string]interface{} {
+	var metas []map[string]interface{}
+	for _, ref := range phxRefs {
+		metas = append(metas, map[string]interface{}{"phx_ref": ref, "device": "d" + ref})
+	}
+	return map[string]interface{}{"metas": metas}
+}
+
+// recordPresence starts a client with presence tracking on testTopic, and
+// returns it with the callback calls it makes.
+func recordPresence(t *testing.T, s *phoenixtest.Server) (*phoenix.Client, *phoenix.Presence, <-chan presenceCall) {
+	c := startClient(s)
+	calls := make(chan presenceCall, 20)
+	p := c.Channel(testTopic).Presence()
+	p.OnJoin(func(key string, current, joined []phoenix.Meta) {
+		calls <- presenceCall{"join", key, refs(current), refs(joined)}
+	})
+	p.OnLeave(func(key string, current, left []phoenix.Meta) {
+		calls <- presenceCall{"leave", key, refs(current), refs(left)}
+	})
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+	return c, p, calls
+}
+
+// expectCalls checks that the next calls are want, in any order.
+func expectCalls(t *testing.T, calls <-chan presenceCall, want ...presenceCall) {
+	var got []presenceCall
+	for range want {
+		select {
+		case call := <-calls:
+			got = append(got, call)
+		case <-time.After(waitFor):
+			t.Fatalf("got presence calls %v, want %v", got, want)
+		}
+	}
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			found = found || g == w
+		}
+		if !found {
+			t.Errorf("got presence calls %v, want %v", got, want)
+			return
+		}
+	}
+}
+
+func TestPresenceMerge(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c, p, calls := recordPresence(t, s)
+	defer c.Close()
+
+	s.Broadcast(testTopic, "presence_state", map[string]interface{}{
+		"alice": presenceEntry("a1"),
+		"bob":   presenceEntry("b1", "b2"),
+	})
+	expectCalls(t, calls,
+		presenceCall{"join", "alice", "", "a1"},
+		presenceCall{"join", "bob", "", "b1,b2"})
+
+	// a second meta joins with the first as current; the last to leave
+	// leaves nothing behind
+	s.Broadcast(testTopic, "presence_diff", map[string]interface{}{
+		"joins":  map[string]interface{}{"alice": presenceEntry("a2"), "carol": presenceEntry("c1")},
+		"leaves": map[string]interface{}{"bob": presenceEntry("b1")},
+	})
+	expectCalls(t, calls,
+		presenceCall{"join", "alice", "a1", "a2"},
+		presenceCall{"join", "carol", "", "c1"},
+		presenceCall{"leave", "bob", "b2", "b1"})
+	s.Broadcast(testTopic, "presence_diff", map[string]interface{}{
+		"leaves": map[string]interface{}{"bob": presenceEntry("b2"), "dave": presenceEntry("d1")},
+	})
+	expectCalls(t, calls, presenceCall{"leave", "bob", "", "b2"})
+
+	list := map[string]string{}
+	for key, metas := range p.List() {
+		list[key] = refs(metas)
+	}
+	if want := map[string]string{"alice": "a1,a2", "carol": "c1"}; !reflect.DeepEqual(list, want) {
+		t.Errorf("List = %v, want %v", list, want)
+	}
+	if device := p.List()["carol"][0]["device"]; device != "dc1" {
+		t.Errorf("carol's meta has device %v", device)
+	}
+
+	// a fresh presence_state, as after a rejoin, is diffed against the
+	// current state
+	s.Broadcast(testTopic, "presence_state", map[string]interface{}{
+		"alice": presenceEntry("a2", "a3"),
+		"erin":  presenceEntry("e1"),
+	})
+	expectCalls(t, calls,
+		presenceCall{"join", "alice", "a1,a2", "a3"},
+		presenceCall{"join", "erin", "", "e1"},
+		presenceCall{"leave", "alice", "a2,a3", "a1"},
+		presenceCall{"leave", "carol", "", "c1"})
+	select {
+	case call := <-calls:
+		t.Errorf("unexpected presence call %v", call)
+	default:
+	}
+}
+
+func TestPresenceTrack(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := phoenix.InitClient(s.URL, []string{testTopic}, []byte("{}"),
+		phoenix.WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond))
+	p := c.Channel(testTopic).Presence()
+	p.SetTrackEvent("track_me")
+
+	// tracked before joining, the meta goes out with the join
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	if err := p.Track(ctx, map[string]string{"device": "gong"}); err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Close()
+	tracks := func() []phoenix.Event {
+		var evts []phoenix.Event
+		for _, evt := range s.Received() {
+			if evt.Topic == testTopic && evt.Event == "track_me" {
+				evts = append(evts, evt)
+			}
+		}
+		return evts
+	}
+	waitUntil(t, "track after join", func() bool { return len(tracks()) == 1 })
+
+	// tracking again while joined pushes now, and the server's verdict is
+	// returned
+	s.SetPushHandler(func(evt phoenix.Event) phoenixtest.Reply {
+		if strings.Contains(string(evt.Payload), "banned") {
+			return phoenixtest.Reply{Status: "error", Response: map[string]string{}}
+		}
+		return phoenixtest.OK
+	})
+	if err := p.Track(ctx, map[string]string{"device": "banned"}); err == nil {
+		t.Error("Track succeeded despite an error reply")
+	} else if _, ok := err.(*phoenix.PushError); !ok {
+		t.Errorf("Track returned %T %v, want a *PushError", err, err)
+	}
+	if err := p.Track(ctx, map[string]string{"device": "bell"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the latest meta is tracked again after a rejoin
+	s.DropConnections()
+	waitUntil(t, "track after rejoin", func() bool { return len(tracks()) == 4 })
+	if got := tracks()[3]; string(got.Payload) != `{"device":"bell"}` {
+		t.Errorf("tracked %s after rejoin", got.Payload)
+	}
+}
@@ -0,0 +1,79 @@
+package phoenix
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// proxyDial returns a dial function that tunnels connections through the
+// HTTP proxy at proxyURL using CONNECT. forward dials the proxy itself. The
+// CONNECT request is sent in plaintext, so proxies with any scheme other than
+// http are refused rather than dialed.
+func proxyDial(proxyURL *url.URL, forward func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	if proxyURL.Scheme != "http" {
+		err := fmt.Errorf("phoenix: unsupported proxy scheme %q, only http proxies are supported", proxyURL.Scheme)
+		return func(network, addr string) (net.Conn, error) {
+			return nil, err
+		}
+	}
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := forward(network, proxyHostPort(proxyURL))
+		if err != nil {
+			return nil, err
+		}
+
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u := proxyURL.User; u != nil {
+			password, _ := u.Password()
+			credentials := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("proxy CONNECT to %s: %s", addr, resp.Status)
+		}
+		if br.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+		return conn, nil
+	}
+}
+
+func proxyHostPort(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host
+	}
+	return u.Host + ":80"
+}
+
+// bufferedConn is a net.Conn whose first reads are served from r, for bytes
+// the proxy sent right after its CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
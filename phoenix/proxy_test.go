@@ -0,0 +1,129 @@
+package phoenix_test
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// connectProxy is an HTTP proxy that only handles CONNECT.
+type connectProxy struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newConnectProxy(t *testing.T) *connectProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &connectProxy{ln: ln}
+	go p.serve()
+	return p
+}
+
+func (p *connectProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.tunnel(conn)
+	}
+}
+
+func (p *connectProxy) tunnel(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.requests = append(p.requests, req)
+	p.mu.Unlock()
+	if req.Method != "CONNECT" {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func (p *connectProxy) seen() []*http.Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*http.Request(nil), p.requests...)
+}
+
+func TestProxy(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	p := newConnectProxy(t)
+	defer p.ln.Close()
+
+	c := startClient(s, phoenix.WithProxy(&url.URL{
+		Scheme: "http",
+		User:   url.UserPassword("gong", "secret"),
+		Host:   p.ln.Addr().String(),
+	}))
+	defer c.Close()
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	reqs := p.seen()
+	if len(reqs) != 1 {
+		t.Fatalf("proxy saw %d requests, want 1", len(reqs))
+	}
+	target, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Host != target.Host {
+		t.Errorf("CONNECT to %s, want %s", reqs[0].Host, target.Host)
+	}
+	// "gong:secret"
+	if auth := reqs[0].Header.Get("Proxy-Authorization"); auth != "Basic Z29uZzpzZWNyZXQ=" {
+		t.Errorf("Proxy-Authorization = %q", auth)
+	}
+}
+
+func TestProxyRejectsOtherSchemes(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	p := newConnectProxy(t)
+	defer p.ln.Close()
+
+	var logs syncBuffer
+	c := startClient(s,
+		phoenix.WithLogger(phoenix.NewStdLogger(log.New(&logs, "", 0), phoenix.LevelWarn)),
+		phoenix.WithProxy(&url.URL{Scheme: "https", Host: p.ln.Addr().String()}))
+	defer c.Close()
+	waitUntil(t, "failed dial", func() bool {
+		return strings.Contains(logs.String(), "unsupported proxy scheme")
+	})
+	time.Sleep(50 * time.Millisecond)
+	if n := len(p.seen()); n != 0 {
+		t.Errorf("proxy saw %d requests", n)
+	}
+	if n := len(s.Requests()); n != 0 {
+		t.Errorf("server saw %d requests", n)
+	}
+}
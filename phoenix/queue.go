@@ -0,0 +1,80 @@
+package phoenix
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens to an inbound event when its delivery
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the longest-queued event to make room.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the incoming event.
+	DropNewest
+	// Block waits for room in the queue. This stalls the connection, including
+	// heartbeats, until the consumer catches up.
+	Block
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Block:
+		return "block"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+const defaultInboundQueueSize = 64
+
+// Dropped returns the number of inbound events discarded because their
+// delivery queue was full.
+func (c *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// enqueue adds evt to q according to the client's overflow policy. It
+// reports whether evt was queued.
+func (c *Client) enqueue(q chan *Event, evt *Event) bool {
+	switch c.overflowPolicy {
+	case Block:
+		select {
+		case q <- evt:
+			return true
+		case <-c.stopping:
+			return false
+		}
+	case DropNewest:
+		select {
+		case q <- evt:
+			return true
+		default:
+			c.drop(evt)
+			return false
+		}
+	default:
+		for {
+			select {
+			case q <- evt:
+				return true
+			default:
+			}
+			select {
+			case old := <-q:
+				c.drop(old)
+			default:
+			}
+		}
+	}
+}
+
+func (c *Client) drop(evt *Event) {
+	atomic.AddUint64(&c.dropped, 1)
+	c.logger.Log(LevelWarn, "inbound queue full, dropping message", eventFields(evt)...)
+}
@@ -0,0 +1,93 @@
+package phoenix_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// broadcastN broadcasts n events to testTopic, with payloads {"n":1} on.
+func broadcastN(t *testing.T, s *phoenixtest.Server, n int) {
+	for i := 1; i <= n; i++ {
+		if _, err := s.Broadcast(testTopic, "new_msg", map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInboundQueueOverflow(t *testing.T) {
+	tests := []struct {
+		policy phoenix.OverflowPolicy
+		want   []int
+	}{
+		{phoenix.DropOldest, []int{3, 4}},
+		{phoenix.DropNewest, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		s := phoenixtest.NewServer()
+		c := startClient(s, phoenix.WithInboundQueue(2, tt.policy))
+		events := c.Events()
+		waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+		// nothing reads the events until all four have arrived
+		broadcastN(t, s, 4)
+		waitUntil(t, fmt.Sprintf("%s drops", tt.policy), func() bool { return c.Dropped() == 2 })
+		for _, n := range tt.want {
+			if evt := nextEvent(t, events); string(evt.Payload) != fmt.Sprintf(`{"n":%d}`, n) {
+				t.Errorf("%s: got %s, want n %d", tt.policy, evt.Payload, n)
+			}
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestInboundQueueBlock(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := startClient(s, phoenix.WithInboundQueue(1, phoenix.Block))
+	defer c.Close()
+
+	// a handler that is slow to start holds up the events behind it
+	release := make(chan struct{})
+	handled := make(chan string, 3)
+	c.Channel(testTopic).On("new_msg", func(evt *phoenix.Event) {
+		<-release
+		handled <- string(evt.Payload)
+	})
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+	broadcastN(t, s, 3)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case got := <-handled:
+			if want := fmt.Sprintf(`{"n":%d}`, i); got != want {
+				t.Errorf("handled %s, want %s", got, want)
+			}
+		case <-time.After(waitFor):
+			t.Fatalf("event %d not handled", i)
+		}
+	}
+	if n := c.Dropped(); n != 0 {
+		t.Errorf("Dropped = %d with Block", n)
+	}
+}
+
+func TestOverflowPolicyString(t *testing.T) {
+	tests := map[phoenix.OverflowPolicy]string{
+		phoenix.DropOldest:         "drop-oldest",
+		phoenix.DropNewest:         "drop-newest",
+		phoenix.Block:              "block",
+		phoenix.OverflowPolicy(-1): "OverflowPolicy(-1)",
+	}
+	for p, want := range tests {
+		if got := p.String(); got != want {
+			t.Errorf("%d.String() = %q, want %q", int(p), got, want)
+		}
+	}
+}
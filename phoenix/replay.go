@@ -0,0 +1,294 @@
+package phoenix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultDedupWindow = 256
+
+// ReplayConfig enables replay of events missed while disconnected. The
+// client remembers the cursor of the last event delivered on each topic and
+// sends it in the join payload, so a server that supports it can replay what
+// came after. Replayed events that were already delivered are dropped.
+//
+// An event counts as delivered once it is queued for its handler or the raw
+// event channel. One dropped because its queue is full is left to be
+// replayed, unless the DropOldest policy evicts it after it was queued.
+type ReplayConfig struct {
+	// Cursor extracts an event's cursor, or "" if it has none. Events
+	// without a cursor are delivered but not tracked. See PayloadField.
+	Cursor func(evt *Event) string
+	// JoinParam is the join payload key the last cursor is sent under.
+	JoinParam string
+	// Store persists cursors across restarts. Changes are saved a second
+	// after the first of them, and when Run returns. If nil, cursors are
+	// kept in memory only.
+	Store CursorStore
+	// DedupWindow is how many recent cursors per topic are remembered to
+	// detect duplicates. The default is 256.
+	DedupWindow int
+}
+
+// PayloadField returns a cursor function reading the top-level payload field
+// name. Numbers are used in their JSON form.
+func PayloadField(name string) func(evt *Event) string {
+	return func(evt *Event) string {
+		fields := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(evt.Payload, &fields); err != nil {
+			return ""
+		}
+		raw, ok := fields[name]
+		if !ok {
+			return ""
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s
+		}
+		var n json.Number
+		if err := json.Unmarshal(raw, &n); err == nil {
+			return n.String()
+		}
+		return ""
+	}
+}
+
+// CursorStore persists the last seen cursor of each topic.
+type CursorStore interface {
+	Load() (map[string]string, error)
+	Save(cursors map[string]string) error
+}
+
+// FileCursorStore keeps cursors as a JSON object in the file at Path.
+type FileCursorStore struct {
+	Path string
+}
+
+func (s FileCursorStore) Load() (map[string]string, error) {
+	cursors := make(map[string]string)
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return cursors, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cursors); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", s.Path, err)
+	}
+	return cursors, nil
+}
+
+// Save writes cursors to a temporary file and renames it over Path, so a
+// crash never leaves a truncated file behind.
+func (s FileCursorStore) Save(cursors map[string]string) error {
+	data, err := json.Marshal(cursors)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// replaySaveDelay is how long cursor changes are collected before they are
+// saved to the store, so a burst of events costs one save.
+const replaySaveDelay = time.Second
+
+type replayTracker struct {
+	cfg ReplayConfig
+	// onSaveError is called with errors from saves made in the background.
+	onSaveError func(error)
+
+	mu      sync.Mutex
+	cursors map[string]string
+	// recent holds the last DedupWindow cursors per topic, oldest first.
+	recent map[string][]string
+	// dirty is set when cursors changed since the last save, which saveTimer
+	// is pending for.
+	dirty     bool
+	saveTimer *time.Timer
+
+	// saveMu serializes saves.
+	saveMu sync.Mutex
+}
+
+func newReplayTracker(cfg ReplayConfig) (*replayTracker, error) {
+	if cfg.DedupWindow <= 0 {
+		cfg.DedupWindow = defaultDedupWindow
+	}
+	r := &replayTracker{
+		cfg:     cfg,
+		cursors: make(map[string]string),
+		recent:  make(map[string][]string),
+	}
+	if cfg.Store == nil {
+		return r, nil
+	}
+	cursors, err := cfg.Store.Load()
+	if err != nil {
+		return r, err
+	}
+	for topic, cursor := range cursors {
+		r.cursors[topic] = cursor
+		r.recent[topic] = []string{cursor}
+	}
+	return r, nil
+}
+
+// check returns evt's cursor and reports whether evt was delivered before.
+func (r *replayTracker) check(evt *Event) (cursor string, dup bool) {
+	cursor = r.cfg.Cursor(evt)
+	if cursor == "" {
+		return "", false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, seen := range r.recent[evt.Topic] {
+		if seen == cursor {
+			return cursor, true
+		}
+	}
+	return cursor, false
+}
+
+// commit records cursor as the last delivered on topic and schedules a save.
+func (r *replayTracker) commit(topic, cursor string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recent := r.recent[topic]
+	if len(recent) >= r.cfg.DedupWindow {
+		recent = recent[1:]
+	}
+	r.recent[topic] = append(recent, cursor)
+	r.cursors[topic] = cursor
+
+	if r.cfg.Store == nil {
+		return
+	}
+	r.dirty = true
+	if r.saveTimer == nil {
+		r.saveTimer = time.AfterFunc(replaySaveDelay, func() {
+			if err := r.save(); err != nil && r.onSaveError != nil {
+				r.onSaveError(err)
+			}
+		})
+	}
+}
+
+// save saves the cursors if they changed since the last save.
+func (r *replayTracker) save() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.Lock()
+	r.saveTimer = nil
+	if !r.dirty {
+		r.mu.Unlock()
+		return nil
+	}
+	r.dirty = false
+	cursors := make(map[string]string, len(r.cursors))
+	for topic, cursor := range r.cursors {
+		cursors[topic] = cursor
+	}
+	r.mu.Unlock()
+
+	if err := r.cfg.Store.Save(cursors); err != nil {
+		r.mu.Lock()
+		r.dirty = true
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// flush saves any cursor changes not saved yet.
+func (r *replayTracker) flush() error {
+	if r.cfg.Store == nil {
+		return nil
+	}
+	r.mu.Lock()
+	if r.saveTimer != nil {
+		r.saveTimer.Stop()
+	}
+	r.mu.Unlock()
+	return r.save()
+}
+
+// joinPayload adds the last cursor of topic to payload under JoinParam.
+func (r *replayTracker) joinPayload(topic string, payload []byte) ([]byte, error) {
+	r.mu.Lock()
+	cursor, ok := r.cursors[topic]
+	r.mu.Unlock()
+	if !ok {
+		return payload, nil
+	}
+
+	withCursor, err := setPayloadFields(payload, map[string]interface{}{r.cfg.JoinParam: cursor})
+	if err != nil {
+		return payload, fmt.Errorf("join payload for %s: %s", topic, err)
+	}
+	return withCursor, nil
+}
+
+// replayJoinPayload returns the join payload for topic with its replay cursor
+// added, if replay is enabled.
+func (c *Client) replayJoinPayload(topic string, payload []byte) []byte {
+	if c.replay == nil {
+		return payload
+	}
+	withCursor, err := c.replay.joinPayload(topic, payload)
+	if err != nil {
+		c.logger.Log(LevelWarn, "adding replay cursor", Field{"topic", topic}, Field{"error", err})
+	}
+	return withCursor
+}
+
+// initReplay sets up replay with cfg, logging any problem with it.
+func (c *Client) initReplay(cfg ReplayConfig) {
+	if cfg.Cursor == nil || cfg.JoinParam == "" {
+		c.logger.Log(LevelWarn, "replay needs a cursor function and a join param, disabling it")
+		return
+	}
+	r, err := newReplayTracker(cfg)
+	if err != nil {
+		c.logger.Log(LevelWarn, "loading replay cursors", Field{"error", err})
+	}
+	r.onSaveError = func(err error) {
+		c.logger.Log(LevelWarn, "saving replay cursors", Field{"error", err})
+	}
+	c.replay = r
+}
+
+// replayCheck returns evt's replay cursor and reports whether evt was
+// already delivered before a replay.
+func (c *Client) replayCheck(evt *Event) (cursor string, dup bool) {
+	if c.replay == nil {
+		return "", false
+	}
+	return c.replay.check(evt)
+}
+
+// replayCommit records cursor as the last delivered on topic.
+func (c *Client) replayCommit(topic, cursor string) {
+	if c.replay != nil && cursor != "" {
+		c.replay.commit(topic, cursor)
+	}
+}
@@ -0,0 +1,142 @@
+package phoenix_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// memoryStore is a CursorStore that records every save.
+type memoryStore struct {
+	mu    sync.Mutex
+	saves []map[string]string
+}
+
+func (s *memoryStore) Load() (map[string]string, error) {
+	return map[string]string{testTopic: "0"}, nil
+}
+
+func (s *memoryStore) Save(cursors map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saves = append(s.saves, cursors)
+	return nil
+}
+
+func (s *memoryStore) saved() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]string(nil), s.saves...)
+}
+
+// failingStore is a CursorStore that cannot load.
+type failingStore struct{ memoryStore }
+
+func (*failingStore) Load() (map[string]string, error) {
+	return nil, errors.New("no cursors file")
+}
+
+func TestReplayLogsThroughLaterLogger(t *testing.T) {
+	var buf bytes.Buffer
+	phoenix.InitClient("ws://localhost/socket/websocket", []string{testTopic}, []byte("{}"),
+		phoenix.WithReplay(phoenix.ReplayConfig{
+			Cursor:    phoenix.PayloadField("id"),
+			JoinParam: "last_seen",
+			Store:     &failingStore{},
+		}),
+		phoenix.WithLogger(phoenix.NewStdLogger(log.New(&buf, "", 0), phoenix.LevelWarn)))
+	if out := buf.String(); !strings.Contains(out, "loading replay cursors") || !strings.Contains(out, "no cursors file") {
+		t.Errorf("log = %q, want the load error", out)
+	}
+}
+
+func TestReplayCursorOnlyAdvancesForQueuedEvents(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	store := &memoryStore{}
+	c := startClient(s,
+		phoenix.WithInboundQueue(2, phoenix.DropNewest),
+		phoenix.WithReplay(phoenix.ReplayConfig{
+			Cursor:    phoenix.PayloadField("id"),
+			JoinParam: "last_seen",
+			Store:     store,
+		}))
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+	join, err := s.WaitForEvent(testTopic, "phx_join", waitFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(join.Payload) != `{"last_seen":"0"}` {
+		t.Errorf("join payload = %s", join.Payload)
+	}
+
+	// nothing reads the events, so only the first two fit
+	for i := 1; i <= 4; i++ {
+		if _, err := s.Broadcast(testTopic, "new_msg", map[string]int{"id": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, "dropped events", func() bool { return c.Dropped() == 2 })
+	c.Close()
+
+	want := []map[string]string{{testTopic: "2"}}
+	if saves := store.saved(); !reflect.DeepEqual(saves, want) {
+		t.Errorf("saves = %v, want %v", saves, want)
+	}
+}
+
+func TestReplayBatchesSaves(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	store := &memoryStore{}
+	c := startClient(s, phoenix.WithReplay(phoenix.ReplayConfig{
+		Cursor:    phoenix.PayloadField("id"),
+		JoinParam: "last_seen",
+		Store:     store,
+	}))
+	defer c.Close()
+	events := c.Events()
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	for i := 1; i <= 20; i++ {
+		if _, err := s.Broadcast(testTopic, "new_msg", map[string]int{"id": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 20; i++ {
+		select {
+		case <-events:
+		case <-time.After(waitFor):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+	waitUntil(t, "save", func() bool { return len(store.saved()) > 0 })
+	want := []map[string]string{{testTopic: "20"}}
+	if saves := store.saved(); !reflect.DeepEqual(saves, want) {
+		t.Errorf("saves = %v, want %v", saves, want)
+	}
+
+	// a replayed duplicate is dropped
+	if _, err := s.Broadcast(testTopic, "new_msg", map[string]int{"id": 20}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Broadcast(testTopic, "new_msg", map[string]int{"id": 21}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case evt := <-events:
+		if string(evt.Payload) != `{"id":21}` {
+			t.Errorf("delivered %s after a duplicate, want id 21", evt.Payload)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("event after duplicate not delivered")
+	}
+}
@@ -0,0 +1,193 @@
+package phoenix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Serializer encodes and decodes messages for one version of the Phoenix
+// socket protocol.
+type Serializer interface {
+	// Vsn is sent as the vsn query parameter when connecting.
+	Vsn() string
+	Encode(evt *Event) ([]byte, error)
+	Decode(data []byte, evt *Event) error
+}
+
+// V1Serializer speaks the 1.0.0 protocol, where every message is a JSON
+// object. It has no notion of join refs.
+type V1Serializer struct{}
+
+func (V1Serializer) Vsn() string { return "1.0.0" }
+
+func (V1Serializer) Encode(evt *Event) ([]byte, error) {
+	return json.Marshal(&v1Message{
+		Topic:   evt.Topic,
+		Event:   evt.Event,
+		Payload: payloadOrEmpty(evt.Payload),
+		Ref:     evt.Ref,
+	})
+}
+
+func (V1Serializer) Decode(data []byte, evt *Event) error {
+	msg := v1Message{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	*evt = Event{
+		Topic:   msg.Topic,
+		Event:   msg.Event,
+		Payload: msg.Payload,
+		Ref:     msg.Ref,
+	}
+	return nil
+}
+
+type v1Message struct {
+	Topic   string          `json:"topic"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+	Ref     string          `json:"ref"`
+}
+
+// V2Serializer speaks the 2.0.0 protocol, where every message is a JSON array
+// of [join_ref, ref, topic, event, payload].
+type V2Serializer struct{}
+
+func (V2Serializer) Vsn() string { return "2.0.0" }
+
+func (V2Serializer) Encode(evt *Event) ([]byte, error) {
+	return json.Marshal([]interface{}{
+		nullableString(evt.JoinRef),
+		nullableString(evt.Ref),
+		evt.Topic,
+		evt.Event,
+		payloadOrEmpty(evt.Payload),
+	})
+}
+
+func (V2Serializer) Decode(data []byte, evt *Event) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 5 {
+		return fmt.Errorf("phoenix: expected 5 message fields, got %d", len(fields))
+	}
+
+	// null unmarshals into a string as a no-op, leaving it empty.
+	var joinRef, ref, topic, event string
+	for i, dst := range []*string{&joinRef, &ref, &topic, &event} {
+		if err := json.Unmarshal(fields[i], dst); err != nil {
+			return fmt.Errorf("phoenix: decoding message field %d: %s", i, err)
+		}
+	}
+	*evt = Event{
+		JoinRef: joinRef,
+		Ref:     ref,
+		Topic:   topic,
+		Event:   event,
+		Payload: fields[4],
+	}
+	return nil
+}
+
+// payloadOrEmpty returns payload, or an empty object if there is none.
+func payloadOrEmpty(payload json.RawMessage) json.RawMessage {
+	if len(payload) == 0 {
+		return json.RawMessage("{}")
+	}
+	return payload
+}
+
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// BinarySerializer is implemented by serializers that also speak Phoenix's
+// binary message format. It is used for events whose Binary field is set and
+// for binary frames from the server.
+type BinarySerializer interface {
+	EncodeBinary(evt *Event) ([]byte, error)
+	DecodeBinary(data []byte, evt *Event) error
+}
+
+// Message kinds of the binary format.
+const (
+	binaryPush      = 0
+	binaryReply     = 1
+	binaryBroadcast = 2
+)
+
+// EncodeBinary encodes evt as a binary push: the kind byte, the lengths of
+// join_ref, ref, topic and event, those four fields, then the raw payload.
+func (V2Serializer) EncodeBinary(evt *Event) ([]byte, error) {
+	fields := []string{evt.JoinRef, evt.Ref, evt.Topic, evt.Event}
+	data := []byte{binaryPush}
+	for _, f := range fields {
+		if len(f) > 255 {
+			return nil, fmt.Errorf("phoenix: binary message field %q longer than 255 bytes", f)
+		}
+		data = append(data, byte(len(f)))
+	}
+	for _, f := range fields {
+		data = append(data, f...)
+	}
+	return append(data, evt.Payload...), nil
+}
+
+// DecodeBinary decodes a binary push, reply or broadcast from the server. The
+// payload is left as raw bytes with Binary set. A reply's status, which JSON
+// replies carry inside the payload, is kept alongside it.
+func (V2Serializer) DecodeBinary(data []byte, evt *Event) error {
+	if len(data) == 0 {
+		return errors.New("phoenix: empty binary message")
+	}
+	var n int
+	switch data[0] {
+	case binaryPush:
+		n = 3 // join_ref, topic, event
+	case binaryReply:
+		n = 4 // join_ref, ref, topic, status
+	case binaryBroadcast:
+		n = 2 // topic, event
+	default:
+		return fmt.Errorf("phoenix: unknown binary message kind %d", data[0])
+	}
+	if len(data) < 1+n {
+		return errors.New("phoenix: short binary message")
+	}
+	fields := make([]string, n)
+	off := 1 + n
+	for i := range fields {
+		size := int(data[1+i])
+		if off+size > len(data) {
+			return errors.New("phoenix: short binary message")
+		}
+		fields[i] = string(data[off : off+size])
+		off += size
+	}
+	payload := data[off:]
+
+	switch data[0] {
+	case binaryPush:
+		*evt = Event{JoinRef: fields[0], Topic: fields[1], Event: fields[2]}
+	case binaryReply:
+		*evt = Event{
+			JoinRef: fields[0],
+			Ref:     fields[1],
+			Topic:   fields[2],
+			Event:   "phx_reply",
+			status:  fields[3],
+		}
+	case binaryBroadcast:
+		*evt = Event{Topic: fields[0], Event: fields[1]}
+	}
+	evt.Payload = payload
+	evt.Binary = true
+	return nil
+}
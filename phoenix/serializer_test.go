@@ -0,0 +1,230 @@
+package phoenix_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+func TestSerializerRoundTrip(t *testing.T) {
+	tests := []struct {
+		ser  phoenix.Serializer
+		evt  phoenix.Event
+		want string
+	}{
+		{
+			phoenix.V1Serializer{},
+			phoenix.Event{Topic: testTopic, Event: "new_msg", Payload: []byte(`{"body":"hi"}`), Ref: "2"},
+			`{"topic":"room:lobby","event":"new_msg","payload":{"body":"hi"},"ref":"2"}`,
+		},
+		{
+			phoenix.V2Serializer{},
+			phoenix.Event{Topic: testTopic, Event: "new_msg", Payload: []byte(`{"body":"hi"}`), Ref: "2", JoinRef: "1"},
+			`["1","2","room:lobby","new_msg",{"body":"hi"}]`,
+		},
+		{
+			phoenix.V2Serializer{},
+			phoenix.Event{Topic: "phoenix", Event: "heartbeat", Payload: []byte(`{}`), Ref: "3"},
+			`[null,"3","phoenix","heartbeat",{}]`,
+		},
+	}
+	for _, tt := range tests {
+		data, err := tt.ser.Encode(&tt.evt)
+		if err != nil {
+			t.Errorf("%s: encoding %+v: %s", tt.ser.Vsn(), tt.evt, err)
+			continue
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: encoded %s, want %s", tt.ser.Vsn(), data, tt.want)
+		}
+		var got phoenix.Event
+		if err := tt.ser.Decode(data, &got); err != nil {
+			t.Errorf("%s: decoding %s: %s", tt.ser.Vsn(), data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.evt) {
+			t.Errorf("%s: decoded %+v, want %+v", tt.ser.Vsn(), got, tt.evt)
+		}
+	}
+}
+
+func TestSerializerEmptyPayload(t *testing.T) {
+	for _, ser := range []phoenix.Serializer{phoenix.V1Serializer{}, phoenix.V2Serializer{}} {
+		data, err := ser.Encode(&phoenix.Event{Topic: testTopic, Event: "phx_join", Ref: "1"})
+		if err != nil {
+			t.Errorf("%s: %s", ser.Vsn(), err)
+			continue
+		}
+		var evt phoenix.Event
+		if err := ser.Decode(data, &evt); err != nil || string(evt.Payload) != "{}" {
+			t.Errorf("%s: encoded %s, decoded payload %s, %v", ser.Vsn(), data, evt.Payload, err)
+		}
+	}
+}
+
+func TestSerializerErrors(t *testing.T) {
+	for _, ser := range []phoenix.Serializer{phoenix.V1Serializer{}, phoenix.V2Serializer{}} {
+		if _, err := ser.Encode(&phoenix.Event{Topic: testTopic, Event: "new_msg", Payload: []byte("not json")}); err == nil {
+			t.Errorf("%s: encoded an invalid payload", ser.Vsn())
+		}
+	}
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{`["1","2","room:lobby","new_msg"]`, "expected 5 message fields, got 4"},
+		{`["1",2,"room:lobby","new_msg",{}]`, "decoding message field 1"},
+		{`{"topic":"room:lobby"}`, "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		var evt phoenix.Event
+		err := phoenix.V2Serializer{}.Decode([]byte(tt.data), &evt)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("decoding %s: %v, want %q", tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestJoinRefs(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := startClient(s, phoenix.WithSerializer(phoenix.V2Serializer{}))
+	defer c.Close()
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	join, err := s.WaitForEvent(testTopic, "phx_join", waitFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.JoinRef == "" || join.JoinRef != join.Ref {
+		t.Errorf("join has ref %q and join_ref %q, want the same", join.Ref, join.JoinRef)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	if _, err := c.Push(ctx, testTopic, "new_msg", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	push, err := s.WaitForEvent(testTopic, "new_msg", waitFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if push.JoinRef != join.Ref {
+		t.Errorf("push join_ref = %q, want %q", push.JoinRef, join.Ref)
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	ser := phoenix.V2Serializer{}
+	payload := []byte{0, 1, 2, 0xff}
+	data, err := ser.EncodeBinary(&phoenix.Event{JoinRef: "1", Ref: "22", Topic: testTopic, Event: "upload", Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{0, 1, 2, 10, 6}, "122room:lobbyupload"...)
+	if want = append(want, payload...); !bytes.Equal(data, want) {
+		t.Errorf("encoded %v, want %v", data, want)
+	}
+	if _, err := ser.EncodeBinary(&phoenix.Event{Topic: strings.Repeat("x", 256)}); err == nil {
+		t.Error("encoded a topic longer than 255 bytes")
+	}
+
+	tests := []struct {
+		data []byte
+		want phoenix.Event
+	}{
+		{
+			append([]byte{0, 1, 10, 3}, "1room:lobbyupdog"...),
+			phoenix.Event{JoinRef: "1", Topic: testTopic, Event: "upd", Payload: []byte("og"), Binary: true},
+		},
+		{
+			append([]byte{2, 10, 3}, "room:lobbyupdog"...),
+			phoenix.Event{Topic: testTopic, Event: "upd", Payload: []byte("og"), Binary: true},
+		},
+	}
+	for _, tt := range tests {
+		var evt phoenix.Event
+		if err := ser.DecodeBinary(tt.data, &evt); err != nil {
+			t.Errorf("decoding %v: %s", tt.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(evt, tt.want) {
+			t.Errorf("decoded %+v, want %+v", evt, tt.want)
+		}
+	}
+
+	for _, data := range [][]byte{nil, {7}, {2, 10}, {2, 10, 3, 'r'}} {
+		var evt phoenix.Event
+		if err := ser.DecodeBinary(data, &evt); err == nil {
+			t.Errorf("decoded %v", data)
+		}
+	}
+}
+
+func TestBinaryPushAndBroadcast(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	// binary pushes are answered with their payload reversed
+	s.SetPushHandler(func(evt phoenix.Event) phoenixtest.Reply {
+		if !evt.Binary {
+			return phoenixtest.Reply{Status: "error", Response: map[string]string{}}
+		}
+		reversed := make([]byte, len(evt.Payload))
+		for i, b := range evt.Payload {
+			reversed[len(reversed)-1-i] = b
+		}
+		return phoenixtest.Reply{Status: "ok", Response: reversed}
+	})
+	c := startClient(s, phoenix.WithSerializer(phoenix.V2Serializer{}))
+	defer c.Close()
+	received := make(chan *phoenix.Event, 1)
+	c.Channel(testTopic).On("frame", func(evt *phoenix.Event) {
+		received <- evt
+	})
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	reply, err := c.Channel(testTopic).PushBinary(ctx, "upload", []byte{0, 1, 2, 0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.OK() || !reply.Binary || !bytes.Equal(reply.Response, []byte{0xff, 2, 1, 0}) {
+		t.Errorf("reply = %+v", reply)
+	}
+	push, err := s.WaitForEvent(testTopic, "upload", waitFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if push.JoinRef == "" || push.Ref != reply.Ref {
+		t.Errorf("push has join_ref %q and ref %q, reply ref %q", push.JoinRef, push.Ref, reply.Ref)
+	}
+
+	if n, err := s.BroadcastBinary(testTopic, "frame", []byte{7, 0, 7}); n != 1 || err != nil {
+		t.Fatalf("broadcast reached %d clients: %v", n, err)
+	}
+	select {
+	case evt := <-received:
+		if !evt.Binary || evt.Topic != testTopic || !bytes.Equal(evt.Payload, []byte{7, 0, 7}) {
+			t.Errorf("received %+v", evt)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("binary broadcast not received")
+	}
+
+	// a client speaking version 1 can neither push nor receive binary
+	v1 := startClient(s)
+	defer v1.Close()
+	waitUntil(t, "version 1 join", func() bool { return v1.TopicState(testTopic) == phoenix.TopicJoined })
+	if _, err := v1.PushBinary(ctx, testTopic, "upload", []byte{1}); err != phoenix.ErrBinaryUnsupported {
+		t.Errorf("binary push over version 1: %v, want %v", err, phoenix.ErrBinaryUnsupported)
+	}
+	if n, _ := s.BroadcastBinary(testTopic, "frame", []byte{1}); n != 1 {
+		t.Errorf("binary broadcast reached %d clients, want only the version 2 one", n)
+	}
+}
@@ -0,0 +1,158 @@
+package phoenix
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnState is the state of the client's connection to the server.
+type ConnState int
+
+const (
+	// StateConnecting means a dial is in progress.
+	StateConnecting ConnState = iota
+	// StateConnected means the socket is open but not every topic is joined.
+	StateConnected
+	// StateJoined means the socket is open and every topic is joined.
+	StateJoined
+	// StateDisconnected means the socket dropped and a reconnect is pending.
+	StateDisconnected
+	// StateClosed means the client was closed and will not reconnect.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateJoined:
+		return "joined"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// Status is a snapshot of the client's connection state.
+type Status struct {
+	State ConnState
+	// Since is when State was entered.
+	Since time.Time
+	// LastHeartbeatReply is when the server last answered a heartbeat. It is
+	// zero if no heartbeat has been answered yet.
+	LastHeartbeatReply time.Time
+	// LastHeartbeatRTT is the round-trip time of that heartbeat.
+	LastHeartbeatRTT time.Duration
+	// Reconnects counts the dials made after the first one.
+	Reconnects int
+}
+
+type statusTracker struct {
+	mu          sync.Mutex
+	status      Status
+	dialed      bool
+	subscribers map[chan Status]struct{}
+}
+
+// Status returns the current connection status.
+func (c *Client) Status() Status {
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	return c.status.status
+}
+
+// Subscribe returns a channel that receives the client's status after every
+// change, starting with the current one, and a function to stop receiving.
+// A slow subscriber only misses intermediate updates; the latest status is
+// always delivered.
+func (c *Client) Subscribe() (<-chan Status, func()) {
+	ch := make(chan Status, 1)
+	c.status.mu.Lock()
+	if c.status.subscribers == nil {
+		c.status.subscribers = make(map[chan Status]struct{})
+	}
+	c.status.subscribers[ch] = struct{}{}
+	ch <- c.status.status
+	c.status.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.status.mu.Lock()
+			defer c.status.mu.Unlock()
+			delete(c.status.subscribers, ch)
+		})
+	}
+}
+
+func (c *Client) setState(state ConnState) {
+	c.updateStatus(func(s *Status) bool {
+		changed := s.State != state
+		if state == StateConnecting {
+			if c.status.dialed {
+				s.Reconnects++
+				changed = true
+			}
+			c.status.dialed = true
+		}
+		if !changed {
+			return false
+		}
+		s.State = state
+		s.Since = time.Now()
+		return true
+	})
+}
+
+func (c *Client) markHeartbeatReply(rtt time.Duration) {
+	c.updateStatus(func(s *Status) bool {
+		s.LastHeartbeatReply = time.Now()
+		s.LastHeartbeatRTT = rtt
+		return true
+	})
+}
+
+// refreshJoined moves between StateConnected and StateJoined depending on
+// whether every topic is currently joined.
+func (c *Client) refreshJoined() {
+	joined := c.allTopicsJoined()
+	c.updateStatus(func(s *Status) bool {
+		var state ConnState
+		switch {
+		case s.State != StateConnected && s.State != StateJoined:
+			return false
+		case joined:
+			state = StateJoined
+		default:
+			state = StateConnected
+		}
+		if s.State == state {
+			return false
+		}
+		s.State = state
+		s.Since = time.Now()
+		return true
+	})
+}
+
+// updateStatus applies f to the status and, if f reports a change, notifies
+// subscribers.
+func (c *Client) updateStatus(f func(*Status) bool) {
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	if !f(&c.status.status) {
+		return
+	}
+	for ch := range c.status.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- c.status.status
+	}
+}
@@ -0,0 +1,102 @@
+package phoenix_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+// waitState reads statuses until one is in state, and returns it along with
+// the states seen before it.
+func waitState(t *testing.T, status <-chan phoenix.Status, state phoenix.ConnState) (phoenix.Status, []phoenix.ConnState) {
+	var seen []phoenix.ConnState
+	deadline := time.After(waitFor)
+	for {
+		select {
+		case st := <-status:
+			if st.State == state {
+				return st, seen
+			}
+			seen = append(seen, st.State)
+		case <-deadline:
+			t.Fatalf("no %s status after %v", state, seen)
+		}
+	}
+}
+
+func TestConnStates(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := phoenix.InitClient(s.URL, []string{testTopic}, []byte("{}"),
+		phoenix.WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond))
+	status, stop := c.Subscribe()
+	defer stop()
+	start := time.Now()
+	c.Start()
+
+	joined, seen := waitState(t, status, phoenix.StateJoined)
+	for _, state := range seen {
+		if state != phoenix.StateConnecting && state != phoenix.StateConnected {
+			t.Errorf("%s before the first join", state)
+		}
+	}
+	if joined.Since.Before(start) || joined.Reconnects != 0 {
+		t.Errorf("joined status = %+v", joined)
+	}
+
+	s.DropConnections()
+	_, seen = waitState(t, status, phoenix.StateDisconnected)
+	for _, state := range seen {
+		if state != phoenix.StateJoined {
+			t.Errorf("%s between joined and disconnected", state)
+		}
+	}
+	rejoined, _ := waitState(t, status, phoenix.StateJoined)
+	if rejoined.Reconnects != 1 || !rejoined.Since.After(joined.Since) {
+		t.Errorf("status after reconnecting = %+v", rejoined)
+	}
+
+	c.Close()
+	waitState(t, status, phoenix.StateClosed)
+	if state := c.Status().State; state != phoenix.StateClosed {
+		t.Errorf("state after Close = %s", state)
+	}
+}
+
+func TestSubscribeStop(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := phoenix.InitClient(s.URL, []string{testTopic}, []byte("{}"))
+	status, stop := c.Subscribe()
+	if st := <-status; st.State != c.Status().State {
+		t.Errorf("first status = %s, want the current one", st.State)
+	}
+	stop()
+	stop()
+	c.Start()
+	waitUntil(t, "join", func() bool { return c.Status().State == phoenix.StateJoined })
+	c.Close()
+	select {
+	case st := <-status:
+		t.Errorf("status %s after stop", st.State)
+	default:
+	}
+}
+
+func TestConnStateString(t *testing.T) {
+	tests := map[phoenix.ConnState]string{
+		phoenix.StateConnecting:   "connecting",
+		phoenix.StateConnected:    "connected",
+		phoenix.StateJoined:       "joined",
+		phoenix.StateDisconnected: "disconnected",
+		phoenix.StateClosed:       "closed",
+		phoenix.ConnState(-1):     "ConnState(-1)",
+	}
+	for state, want := range tests {
+		if got := state.String(); got != want {
+			t.Errorf("%d.String() = %q, want %q", int(state), got, want)
+		}
+	}
+}
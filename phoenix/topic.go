@@ -0,0 +1,426 @@
+package phoenix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/jpillora/backoff"
+)
+
+// TopicState is the join state of a single topic.
+type TopicState int
+
+const (
+	// TopicClosed means the topic is not joined and no join is in flight,
+	// e.g. because the socket is disconnected.
+	TopicClosed TopicState = iota
+	// TopicJoining means a phx_join has been sent and its reply is pending.
+	TopicJoining
+	// TopicJoined means the server accepted the join.
+	TopicJoined
+	// TopicRejoining means the join failed or the server errored/closed the
+	// topic, and a rejoin is scheduled.
+	TopicRejoining
+)
+
+func (s TopicState) String() string {
+	switch s {
+	case TopicClosed:
+		return "closed"
+	case TopicJoining:
+		return "joining"
+	case TopicJoined:
+		return "joined"
+	case TopicRejoining:
+		return "rejoining"
+	}
+	return fmt.Sprintf("TopicState(%d)", int(s))
+}
+
+// JoinError describes a phx_join that the server answered with a non-ok
+// status.
+type JoinError struct {
+	Topic    string
+	Status   string
+	Reason   string
+	Response json.RawMessage
+}
+
+func (e *JoinError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("phoenix: joining %s: status %s", e.Topic, e.Status)
+	}
+	return fmt.Sprintf("phoenix: joining %s: status %s: %s", e.Topic, e.Status, e.Reason)
+}
+
+type topicState struct {
+	state       TopicState
+	joinFunc    TopicJoinFunc
+	leaving     bool
+	joinRef     string
+	backoff     backoff.Backoff
+	rejoinTimer *time.Timer
+}
+
+func newTopicState(joinFunc TopicJoinFunc) *topicState {
+	return &topicState{
+		joinFunc: joinFunc,
+		backoff: backoff.Backoff{
+			Min:    time.Second,
+			Max:    30 * time.Second,
+			Factor: 2,
+			Jitter: true,
+		},
+	}
+}
+
+// Join subscribes to topic, sending payload with every (re)join. It may be
+// called at any time; if the client is connected the topic is joined
+// immediately, otherwise on the next connect.
+func (c *Client) Join(topic string, payload []byte) {
+	c.JoinFunc(topic, func(string) string { return string(payload) })
+}
+
+// JoinFunc is like Join, but f is called to compute the join payload each time
+// topic is (re)joined.
+func (c *Client) JoinFunc(topic string, f TopicJoinFunc) {
+	c.topicsMu.Lock()
+	if ts, ok := c.topicStates[topic]; ok {
+		ts.joinFunc = f
+		ts.leaving = false
+	} else {
+		c.topics = append(c.topics, topic)
+		c.topicStates[topic] = newTopicState(f)
+	}
+	c.topicsMu.Unlock()
+	c.kickTopics()
+}
+
+// Leave unsubscribes from topic, sending phx_leave if it is currently joined.
+// The topic is not rejoined on reconnect.
+func (c *Client) Leave(topic string) {
+	c.topicsMu.Lock()
+	ts, ok := c.topicStates[topic]
+	if !ok {
+		c.topicsMu.Unlock()
+		return
+	}
+	if ts.state == TopicClosed {
+		c.removeTopicLocked(topic)
+	} else {
+		ts.leaving = true
+	}
+	c.topicsMu.Unlock()
+	c.kickTopics()
+}
+
+// Topics returns the currently subscribed topics.
+func (c *Client) Topics() []string {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	topics := make([]string, 0, len(c.topics))
+	for _, topic := range c.topics {
+		if !c.topicStates[topic].leaving {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+func (c *Client) allTopicsJoined() bool {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	if len(c.topics) == 0 {
+		return false
+	}
+	for _, ts := range c.topicStates {
+		if ts.state != TopicJoined {
+			return false
+		}
+	}
+	return true
+}
+
+// kickTopics wakes the connection goroutine so it picks up topic changes.
+func (c *Client) kickTopics() {
+	select {
+	case c.topicsKickc <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) removeTopicLocked(topic string) {
+	if ts := c.topicStates[topic]; ts != nil && ts.rejoinTimer != nil {
+		ts.rejoinTimer.Stop()
+	}
+	delete(c.topicStates, topic)
+	for i, t := range c.topics {
+		if t == topic {
+			c.topics = append(c.topics[:i], c.topics[i+1:]...)
+			break
+		}
+	}
+}
+
+// syncTopics joins every topic that is not yet joined on conn and leaves the
+// topics that were unsubscribed.
+func (c *Client) syncTopics(conn TransportConn) error {
+	var toJoin []string
+	toLeave := make(map[string]string)
+	c.topicsMu.Lock()
+	for _, topic := range append([]string(nil), c.topics...) {
+		ts := c.topicStates[topic]
+		switch {
+		case ts.leaving && ts.state == TopicClosed:
+			c.removeTopicLocked(topic)
+		case ts.leaving:
+			toLeave[topic] = ts.joinRef
+			c.removeTopicLocked(topic)
+		case ts.state == TopicClosed:
+			toJoin = append(toJoin, topic)
+		}
+	}
+	c.topicsMu.Unlock()
+
+	for topic, joinRef := range toLeave {
+		if err := c.sendLeave(conn, topic, joinRef); err != nil {
+			return err
+		}
+	}
+	for _, topic := range toJoin {
+		if err := c.sendJoin(conn, topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnJoinError registers f to be called whenever the server rejects a join.
+// It must be called before Start. f runs on the connection goroutine, so it
+// should not block.
+func (c *Client) OnJoinError(f func(*JoinError)) {
+	c.joinErrorFunc = f
+}
+
+// TopicState returns the current join state of topic.
+func (c *Client) TopicState(topic string) TopicState {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	if ts, ok := c.topicStates[topic]; ok {
+		return ts.state
+	}
+	return TopicClosed
+}
+
+// sendJoin sends phx_join for topic, unless it has been unsubscribed in the
+// meantime.
+func (c *Client) sendJoin(conn TransportConn, topic string) error {
+	ref := c.makeRef()
+	c.topicsMu.Lock()
+	ts, ok := c.topicStates[topic]
+	if !ok || ts.leaving {
+		c.topicsMu.Unlock()
+		return nil
+	}
+	ts.state = TopicJoining
+	ts.joinRef = ref
+	joinFunc := ts.joinFunc
+	c.topicsMu.Unlock()
+	c.outbox.requeueTopic(topic)
+
+	payload := []byte(joinFunc(topic))
+	if len(bytes.TrimSpace(payload)) == 0 {
+		payload = []byte("{}")
+	}
+	payload, err := c.credentialsJoinPayload(topic, payload)
+	if err != nil {
+		c.logger.Log(LevelWarn, "joining", Field{"topic", topic}, Field{"error", err})
+		c.scheduleRejoin(topic)
+		return nil
+	}
+	joinMsg := Event{
+		Topic:   topic,
+		Event:   "phx_join",
+		Payload: c.replayJoinPayload(topic, payload),
+		Ref:     ref,
+		JoinRef: ref,
+	}
+	// A payload that cannot be encoded only keeps its own topic from joining.
+	data, binary, err := c.encodeEvent(&joinMsg)
+	if err != nil {
+		c.logger.Log(LevelWarn, "joining", Field{"topic", topic}, Field{"error", err})
+		c.scheduleRejoin(topic)
+		return nil
+	}
+	return conn.WriteMessage(data, binary)
+}
+
+func (c *Client) sendLeave(conn TransportConn, topic, joinRef string) error {
+	leaveMsg := Event{
+		Topic:   topic,
+		Event:   "phx_leave",
+		Payload: []byte("{}"),
+		Ref:     c.makeRef(),
+		JoinRef: joinRef,
+	}
+	return c.writeEvent(conn, &leaveMsg)
+}
+
+// leaveTopics sends phx_leave for every topic that is joined or being joined
+// on conn. The topics stay subscribed.
+func (c *Client) leaveTopics(conn TransportConn) error {
+	joinRefs := make(map[string]string)
+	c.topicsMu.Lock()
+	for topic, ts := range c.topicStates {
+		if ts.state == TopicJoined || ts.state == TopicJoining {
+			joinRefs[topic] = ts.joinRef
+		}
+	}
+	c.topicsMu.Unlock()
+
+	for topic, joinRef := range joinRefs {
+		if err := c.sendLeave(conn, topic, joinRef); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canPush reports whether a push to topic may be written now.
+func (c *Client) canPush(topic string) bool {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	ts, ok := c.topicStates[topic]
+	return !ok || ts.state == TopicJoined
+}
+
+// joinRef returns the ref of the current join of topic, or "" if the topic
+// is not subscribed.
+func (c *Client) joinRef(topic string) string {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	if ts, ok := c.topicStates[topic]; ok {
+		return ts.joinRef
+	}
+	return ""
+}
+
+// isStale reports whether evt belongs to an earlier join of its topic than
+// the current one. Messages without a join ref are never stale.
+func (c *Client) isStale(evt *Event) bool {
+	if evt.JoinRef == "" {
+		return false
+	}
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	ts, ok := c.topicStates[evt.Topic]
+	return ok && ts.joinRef != "" && ts.joinRef != evt.JoinRef
+}
+
+// handleJoinReply processes evt if it answers the outstanding join for its
+// topic, and reports whether it did.
+func (c *Client) handleJoinReply(evt *Event) bool {
+	c.topicsMu.Lock()
+	ts, ok := c.topicStates[evt.Topic]
+	isJoinReply := ok && ts.state == TopicJoining && ts.joinRef == evt.Ref
+	c.topicsMu.Unlock()
+	if !isJoinReply {
+		return false
+	}
+
+	payload, err := decodeReply(evt)
+	if err != nil {
+		c.logger.Log(LevelWarn, "unmarshaling phx_join reply", append(eventFields(evt), Field{"error", err})...)
+	}
+	if payload.Status == "ok" {
+		c.topicsMu.Lock()
+		ts.state = TopicJoined
+		ts.backoff.Reset()
+		c.topicsMu.Unlock()
+		c.logger.Log(LevelInfo, "joined", Field{"topic", evt.Topic}, Field{"join_ref", evt.Ref})
+		c.joinedTopics = append(c.joinedTopics, evt.Topic)
+		return true
+	}
+
+	reason := struct {
+		Reason string `json:"reason"`
+	}{}
+	json.Unmarshal(payload.Response, &reason)
+	joinErr := &JoinError{
+		Topic:    evt.Topic,
+		Status:   payload.Status,
+		Reason:   reason.Reason,
+		Response: payload.Response,
+	}
+	c.logger.Log(LevelWarn, "join rejected",
+		Field{"topic", joinErr.Topic},
+		Field{"status", joinErr.Status},
+		Field{"reason", joinErr.Reason})
+	if joinErr.Reason == "unauthorized" && c.credentialsFunc != nil {
+		c.credentialsRejected = true
+	}
+	if c.joinErrorFunc != nil {
+		c.joinErrorFunc(joinErr)
+	}
+	c.scheduleRejoin(evt.Topic)
+	return true
+}
+
+// handleTopicClosed moves topic back to rejoining after the server reports
+// phx_error or phx_close for it.
+func (c *Client) handleTopicClosed(evt *Event) {
+	c.topicsMu.Lock()
+	_, ok := c.topicStates[evt.Topic]
+	c.topicsMu.Unlock()
+	if !ok {
+		return
+	}
+	c.logger.Log(LevelWarn, "topic closed by server, rejoining", eventFields(evt)...)
+	c.scheduleRejoin(evt.Topic)
+}
+
+// scheduleRejoin arranges for topic to be rejoined on the current connection
+// after its backoff elapses. The rejoin is abandoned if the connection drops
+// first; every topic is joined again on reconnect anyway.
+func (c *Client) scheduleRejoin(topic string) {
+	rejoinc, connDone := c.rejoinc, c.connDone
+
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	ts, ok := c.topicStates[topic]
+	if !ok || ts.leaving {
+		return
+	}
+	ts.state = TopicRejoining
+	if ts.rejoinTimer != nil {
+		ts.rejoinTimer.Stop()
+	}
+	ts.rejoinTimer = time.AfterFunc(ts.backoff.Duration(), func() {
+		select {
+		case rejoinc <- topic:
+		case <-connDone:
+		}
+	})
+}
+
+// closeTopics marks every topic closed and cancels pending rejoins once the
+// connection is gone.
+func (c *Client) closeTopics() {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	for _, topic := range append([]string(nil), c.topics...) {
+		ts := c.topicStates[topic]
+		if ts.leaving {
+			c.removeTopicLocked(topic)
+			continue
+		}
+		ts.state = TopicClosed
+		ts.joinRef = ""
+		if ts.rejoinTimer != nil {
+			ts.rejoinTimer.Stop()
+			ts.rejoinTimer = nil
+		}
+	}
+}
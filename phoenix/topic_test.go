@@ -0,0 +1,84 @@
+package phoenix_test
+
+import (
+	"testing"
+
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+func TestTopicStates(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := phoenix.InitClient(s.URL, []string{testTopic}, []byte("{}"))
+	if state := c.TopicState(testTopic); state != phoenix.TopicClosed {
+		t.Errorf("state before Start = %s, want %s", state, phoenix.TopicClosed)
+	}
+	if state := c.TopicState("room:other"); state != phoenix.TopicClosed {
+		t.Errorf("state of unsubscribed topic = %s, want %s", state, phoenix.TopicClosed)
+	}
+	c.Start()
+	defer c.Close()
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+
+	for i, event := range []string{"phx_error", "phx_close"} {
+		if _, err := s.Broadcast(testTopic, event, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+		waitUntil(t, event, func() bool { return c.TopicState(testTopic) == phoenix.TopicRejoining })
+		waitUntil(t, "rejoin after "+event, func() bool {
+			return c.TopicState(testTopic) == phoenix.TopicJoined && joins(s) == i+2
+		})
+	}
+	if got := c.Status().Reconnects; got != 0 {
+		t.Errorf("Reconnects = %d, want topics rejoined on the same connection", got)
+	}
+}
+
+func TestTopicStateString(t *testing.T) {
+	tests := map[phoenix.TopicState]string{
+		phoenix.TopicClosed:    "closed",
+		phoenix.TopicJoining:   "joining",
+		phoenix.TopicJoined:    "joined",
+		phoenix.TopicRejoining: "rejoining",
+		phoenix.TopicState(-1): "TopicState(-1)",
+	}
+	for state, want := range tests {
+		if got := state.String(); got != want {
+			t.Errorf("%d.String() = %q, want %q", int(state), got, want)
+		}
+	}
+}
+
+func TestJoinWithoutPayload(t *testing.T) {
+	for _, ser := range []phoenix.Serializer{phoenix.V1Serializer{}, phoenix.V2Serializer{}} {
+		s := phoenixtest.NewServer()
+		c := phoenix.InitClient(s.URL, nil, nil, phoenix.WithSerializer(ser))
+		c.Join(testTopic, nil)
+		c.Start()
+		waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+		join, err := s.WaitForEvent(testTopic, "phx_join", waitFor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(join.Payload) != "{}" {
+			t.Errorf("%s: join payload = %s, want {}", ser.Vsn(), join.Payload)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestUnencodableJoinPayload(t *testing.T) {
+	s := phoenixtest.NewServer()
+	defer s.Close()
+	c := startClient(s)
+	c.Join("room:bad", []byte("not json"))
+	defer c.Close()
+
+	waitUntil(t, "join", func() bool { return c.TopicState(testTopic) == phoenix.TopicJoined })
+	waitUntil(t, "failed join", func() bool { return c.TopicState("room:bad") == phoenix.TopicRejoining })
+	if st := c.Status(); st.State != phoenix.StateConnected || st.Reconnects != 0 {
+		t.Errorf("status = %s with %d reconnects, want the connection kept", st.State, st.Reconnects)
+	}
+}
@@ -0,0 +1,95 @@
+package phoenix
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/gorilla/websocket"
+)
+
+// Transport opens connections to a Phoenix socket. Transports only carry
+// encoded messages; the client speaks the channel protocol (joins,
+// heartbeats, replies) the same way over any of them.
+type Transport interface {
+	// Name identifies the transport in logs, e.g. "websocket".
+	Name() string
+	// Dial connects to the socket whose websocket endpoint is rawurl,
+	// including the vsn query parameter, sending header with the request.
+	Dial(rawurl string, header http.Header) (TransportConn, error)
+}
+
+// TransportConn is a connection opened by a Transport. ReadMessage is called
+// from one goroutine while the others are called from another.
+type TransportConn interface {
+	// ReadMessage blocks until the next message from the server arrives.
+	// binary reports whether it came in binary form.
+	ReadMessage() (data []byte, binary bool, err error)
+	// WriteMessage sends one encoded message to the server.
+	WriteMessage(data []byte, binary bool) error
+	// Shutdown starts a graceful close. Once the server has acknowledged it,
+	// ReadMessage returns an error.
+	Shutdown() error
+	// Close tears the connection down immediately, unblocking ReadMessage.
+	Close() error
+	// RemoteAddr describes the server end of the connection.
+	RemoteAddr() string
+}
+
+// WebSocketTransport is the default transport.
+type WebSocketTransport struct {
+	Dialer *websocket.Dialer
+	// Compression offers permessage-deflate when connecting.
+	Compression bool
+}
+
+func (t *WebSocketTransport) Name() string { return "websocket" }
+
+func (t *WebSocketTransport) Dial(rawurl string, header http.Header) (TransportConn, error) {
+	var ws *websocket.Conn
+	var resp *http.Response
+	var err error
+	// per docs, resp.Body doesn't need to be closed
+	if t.Compression {
+		ws, resp, err = dialDeflate(t.Dialer, rawurl, header)
+	} else {
+		ws, resp, err = t.Dialer.Dial(rawurl, header)
+	}
+	if err == websocket.ErrBadHandshake && resp != nil {
+		return nil, &HandshakeError{StatusCode: resp.StatusCode}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wsConn{ws}, nil
+}
+
+type wsConn struct {
+	ws *websocket.Conn
+}
+
+func (c wsConn) ReadMessage() ([]byte, bool, error) {
+	msgType, data, err := c.ws.ReadMessage()
+	return data, msgType == websocket.BinaryMessage, err
+}
+
+func (c wsConn) WriteMessage(data []byte, binary bool) error {
+	if binary {
+		return c.ws.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// Shutdown sends a close frame; the server answers with its own, which ends
+// reading.
+func (c wsConn) Shutdown() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	return c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+func (c wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c wsConn) RemoteAddr() string {
+	return c.ws.RemoteAddr().String()
+}
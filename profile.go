@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/opendoor-labs/gong/choreography"
+)
+
+// defaultProfiles describe the two hardware revisions the gong shipped on.
+const defaultProfiles = `{
+  "default": "original",
+  "profiles": {
+    "original": {
+      "i2c_bus": 1, "address": 64, "frequency": 100, "idle": 350,
+      "instruments": {
+        "bell": {"type": "bell", "channel": 5, "rest": 350, "strike": 650, "min": 350, "max": 650},
+        "chime": {"type": "chime", "channel": 6, "rest": 600, "strike": 330, "min": 330, "max": 600}
+      }
+    },
+    "new": {
+      "i2c_bus": 1, "address": 64, "frequency": 100, "idle": 600,
+      "instruments": {
+        "bell": {"type": "bell", "channel": 5, "rest": 600, "strike": 800, "min": 600, "max": 800},
+        "chime": {"type": "chime", "channel": 6, "rest": 280, "strike": 200, "sequence": "chime-new", "min": 200, "max": 280}
+      }
+    }
+  }
+}`
+
+// profileConfig holds the hardware profiles and which device uses which, e.g.
+//
+//	{
+//	  "default": "original",
+//	  "devices": {"<RESIN_DEVICE_UUID>": "rev3"},
+//	  "profiles": {
+//	    "rev3": {
+//	      "i2c_bus": 1, "address": 65, "frequency": 50,
+//	      "instruments": {
+//	        "bell": {"type": "bell", "channel": 0, "rest": 205, "strike": 410, "min": 150, "max": 450}
+//	      }
+//	    }
+//	  }
+//	}
+type profileConfig struct {
+	// Default names the profile for devices not listed in Devices.
+	Default string `json:"default,omitempty"`
+	// Devices maps device IDs to profile names.
+	Devices  map[string]string   `json:"devices,omitempty"`
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+// profile describes one hardware revision: where its servo controller is and
+// what each channel drives.
+type profile struct {
+	Name      string `json:"-"`
+	Bus       byte   `json:"i2c_bus"`
+	Address   byte   `json:"address"`
+	Frequency int    `json:"frequency"`
+	// Idle, if set, is the PWM value channels without an instrument are
+	// reset to.
+	Idle        *int                   `json:"idle,omitempty"`
+	Instruments map[string]*instrument `json:"instruments"`
+}
+
+// instrument is a striker driven by one channel of the servo controller.
+type instrument struct {
+	choreography.Instrument
+	// Type is the kind of instrument, such as "bell" or "chime".
+	Type string `json:"type"`
+	// Sequence is the choreography the instrument plays by default. It
+	// defaults to the instrument's type.
+	Sequence string `json:"sequence,omitempty"`
+}
+
+// sequence returns the name of the choreography to play on the instrument:
+// name if it is set, or else its default.
+func (inst *instrument) sequence(name string) string {
+	switch {
+	case name != "":
+		return name
+	case inst.Sequence != "":
+		return inst.Sequence
+	}
+	return inst.Type
+}
+
+// loadProfiles reads the hardware profiles in the file at path on top of the
+// bundled ones, or just the bundled ones if path is empty.
+func loadProfiles(path string) (*profileConfig, error) {
+	cfg := &profileConfig{}
+	if err := json.Unmarshal([]byte(defaultProfiles), cfg); err != nil {
+		panic("bad default hardware profiles: " + err.Error())
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file := &profileConfig{}
+		if err := json.Unmarshal(data, file); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if file.Default != "" {
+			cfg.Default = file.Default
+		}
+		cfg.Devices = file.Devices
+		for name, p := range file.Profiles {
+			cfg.Profiles[name] = p
+		}
+	}
+	for name, p := range cfg.Profiles {
+		if p == nil {
+			return nil, fmt.Errorf("profile %s is empty", name)
+		}
+		p.Name = name
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("profile %s: %s", name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// selectProfile returns the profile called name if it is set, else the one
+// the config assigns to deviceID, else "new" if the legacy NEW_HARDWARE flag
+// is set, else the default.
+func (cfg *profileConfig) selectProfile(name, deviceID string) (*profile, error) {
+	if name == "" {
+		name = cfg.Devices[deviceID]
+	}
+	if name == "" && os.Getenv("NEW_HARDWARE") != "" {
+		name = "new"
+	}
+	if name == "" {
+		name = cfg.Default
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no hardware profile %q", name)
+	}
+	return p, nil
+}
+
+func (p *profile) validate() error {
+	if p.Frequency < 24 || p.Frequency > 1526 {
+		return fmt.Errorf("frequency %d out of range", p.Frequency)
+	}
+	if p.Idle != nil && (*p.Idle < 0 || *p.Idle > 4095) {
+		return fmt.Errorf("idle %d out of range", *p.Idle)
+	}
+	channels := make(map[int]string)
+	for name, inst := range p.Instruments {
+		if inst == nil {
+			return fmt.Errorf("instrument %s is empty", name)
+		}
+		if err := inst.Validate(); err != nil {
+			return fmt.Errorf("instrument %s: %s", name, err)
+		}
+		if inst.sequence("") == "" {
+			return fmt.Errorf("instrument %s has no type or sequence", name)
+		}
+		if other, ok := channels[inst.Channel]; ok {
+			return fmt.Errorf("instruments %s and %s share channel %d", name, other, inst.Channel)
+		}
+		channels[inst.Channel] = name
+	}
+	return nil
+}
+
+// checkSequences checks that the default sequence of every instrument exists.
+func (p *profile) checkSequences(sequences choreography.Library) error {
+	for name, inst := range p.Instruments {
+		if _, err := sequences.Get(inst.sequence("")); err != nil {
+			return fmt.Errorf("profile %s instrument %s: %s", p.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// instrumentNames returns the names of the profile's instruments in order.
+func (p *profile) instrumentNames() []string {
+	names := make([]string, 0, len(p.Instruments))
+	for name := range p.Instruments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/jpillora/backoff"
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/choreography"
+)
+
+// maxStrikeFailures is how many strikes in a row may fail, without the
+// controller even accepting the return to rest, before it is considered
+// unreachable and the process exits.
+const maxStrikeFailures = 5
+
+// ringer plays strike sequences on the instruments of a hardware profile.
+// Each instrument plays the strikes queued on it in turn, while different
+// instruments play at the same time. Controller calls are retried; a strike
+// that still fails returns its instrument to rest and puts the controller to
+// sleep rather than leaving the servo mid-strike.
+type ringer struct {
+	sequences choreography.Library
+	hw        *profile
+	queues    map[string]*instrumentQueue
+	wg        sync.WaitGroup
+
+	mu sync.Mutex
+	// i2cErrors counts every failed controller call, retried or not.
+	i2cErrors int
+	// failures counts the strikes in a row that failed and could not be
+	// recovered from.
+	failures int
+	// delayed counts strikes waiting to be queued by StrikeAfter.
+	delayed int
+}
+
+// newRinger returns a ringer that drives dev, retrying transient errors, and
+// starts playing queued strikes until ctx is done.
+func newRinger(ctx context.Context, dev choreography.Controller, freq int, hw *profile, sequences choreography.Library) *ringer {
+	r := &ringer{
+		sequences: sequences,
+		hw:        hw,
+		queues:    make(map[string]*instrumentQueue),
+	}
+	c := &chip{dev: dev}
+	for name, inst := range hw.Instruments {
+		retry := &choreography.Retry{
+			Dev:      &session{chip: c},
+			Attempts: 3,
+			Backoff: backoff.Backoff{
+				Min:    20 * time.Millisecond,
+				Max:    200 * time.Millisecond,
+				Factor: 2,
+			},
+			Transient: isTransientI2CError,
+			OnError:   r.countError,
+		}
+		q := &instrumentQueue{
+			name:   name,
+			inst:   inst,
+			player: &choreography.Player{Dev: retry, Freq: freq},
+			ready:  make(chan struct{}, 1),
+		}
+		r.queues[name] = q
+		r.wg.Add(1)
+		go r.playQueue(ctx, q)
+	}
+	return r
+}
+
+// isTransientI2CError reports whether err may go away on retry. Failing to
+// open the bus device or lacking permission to will not.
+func isTransientI2CError(err error) bool {
+	return !os.IsNotExist(err) && !os.IsPermission(err)
+}
+
+func (r *ringer) countError(err error) {
+	r.mu.Lock()
+	r.i2cErrors++
+	r.mu.Unlock()
+}
+
+// errorCount returns the number of failed controller calls so far.
+func (r *ringer) errorCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.i2cErrors
+}
+
+// play plays a run of queued strikes on q's instrument as one roll. If the
+// controller fails, the instrument is returned to rest; if it keeps failing,
+// the process exits.
+func (r *ringer) play(q *instrumentQueue, s queuedStrike) {
+	seq, err := r.sequences.Get(s.sequence)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	err = q.player.Play(choreography.Roll(seq, s.count), q.inst.Instrument)
+	if err != nil {
+		log.Printf("ringing %s failed (%d I2C errors in total): %s", q.name, r.errorCount(), err)
+		if err = rest(q.player.Dev, q.inst); err != nil {
+			log.Printf("returning %s to rest: %s", q.name, err)
+		}
+	}
+
+	r.mu.Lock()
+	if err == nil {
+		r.failures = 0
+	} else {
+		r.failures++
+	}
+	failures := r.failures
+	r.mu.Unlock()
+	if failures >= maxStrikeFailures {
+		log.Fatalf("servo controller unreachable: %d strikes failed in a row", failures)
+	}
+}
+
+// rest moves inst back to its rest position and puts dev to sleep, even if
+// the move fails.
+func rest(dev choreography.Controller, inst *instrument) error {
+	setErr := dev.SetPwm(inst.Channel, 0, inst.Rest)
+	if setErr == nil {
+		// give the servo time to get there before its power is cut
+		time.Sleep(400 * time.Millisecond)
+	}
+	if err := dev.Sleep(); err != nil {
+		return fmt.Errorf("sleeping: %s", err)
+	}
+	if setErr != nil {
+		return fmt.Errorf("setting channel %d to %d: %s", inst.Channel, inst.Rest, setErr)
+	}
+	return nil
+}
+
+// loadSequences returns the bundled strike sequences, overridden by those in
+// path if it is set.
+func loadSequences(path string) (choreography.Library, error) {
+	if path == "" {
+		return choreography.Defaults(), nil
+	}
+	return choreography.Load(path)
+}
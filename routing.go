@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/opendoor-labs/gong/choreography"
+	"github.com/opendoor-labs/gong/phoenix"
+)
+
+// defaultRoutes ring the bell for acquisitions and the chime for resales.
+const defaultRoutes = `{
+  "routes": [
+    {"event": "acquisition_contract", "ring": [{"instrument": "bell"}]},
+    {"event": "resale_contract", "ring": [{"instrument": "chime"}]}
+  ]
+}`
+
+// routingTable decides which instruments an event rings. Routes are tried in
+// order and the first whose event and conditions match wins, e.g.
+//
+//	{
+//	  "routes": [
+//	    {"event": "acquisition_contract",
+//	     "where": {"market": "phoenix", "price": {"gte": 500000}},
+//	     "ring": [{"instrument": "bell", "sequence": "bell-double"}, {"instrument": "chime"}]},
+//	    {"event": "acquisition_contract", "ring": [{"instrument": "bell"}]}
+//	  ]
+//	}
+type routingTable struct {
+	Routes []route `json:"routes"`
+}
+
+type route struct {
+	Event string `json:"event"`
+	// Where holds conditions on payload fields, by field name. Nested fields
+	// are named with dots, e.g. "address.city".
+	Where map[string]condition `json:"where,omitempty"`
+	// Ring lists the strikes to play, in order.
+	Ring []strike `json:"ring"`
+}
+
+type strike struct {
+	Instrument string `json:"instrument"`
+	// Sequence is the choreography to play. It defaults to the instrument's.
+	Sequence string `json:"sequence,omitempty"`
+}
+
+func (s strike) String() string {
+	if s.Sequence == "" {
+		return s.Instrument
+	}
+	return s.Instrument + ":" + s.Sequence
+}
+
+// condition tests one payload field. In JSON it is either a value the field
+// must equal or an object of operators, all of which must hold:
+// eq, ne, in, exists, and the numeric gt, gte, lt and lte.
+type condition struct {
+	Eq     interface{}   `json:"eq,omitempty"`
+	Ne     interface{}   `json:"ne,omitempty"`
+	In     []interface{} `json:"in,omitempty"`
+	Exists *bool         `json:"exists,omitempty"`
+	Gt     *float64      `json:"gt,omitempty"`
+	Gte    *float64      `json:"gte,omitempty"`
+	Lt     *float64      `json:"lt,omitempty"`
+	Lte    *float64      `json:"lte,omitempty"`
+}
+
+func (c *condition) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	// a null would leave the condition empty, matching anything
+	if isNull(data) {
+		return errors.New(`null condition; use {"exists": false} for a missing field`)
+	}
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return json.Unmarshal(data, &c.Eq)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for op, value := range fields {
+		switch op {
+		case "eq", "ne", "in", "exists", "gt", "gte", "lt", "lte":
+		default:
+			return fmt.Errorf("unknown condition operator %q", op)
+		}
+		if isNull(value) {
+			return fmt.Errorf("null value for condition operator %q", op)
+		}
+	}
+	type ops condition
+	return json.Unmarshal(data, (*ops)(c))
+}
+
+func isNull(data []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(data), []byte("null"))
+}
+
+// parseRoutes reads a routing table and checks that it only names instruments
+// in hw and known sequences.
+func parseRoutes(data []byte, hw *profile, sequences choreography.Library) (*routingTable, error) {
+	t := &routingTable{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	for i, rt := range t.Routes {
+		switch rt.Event {
+		case "":
+			return nil, fmt.Errorf("route %d: no event", i)
+		case systemTestEvent:
+			return nil, fmt.Errorf("route %d: %s cannot be routed", i, rt.Event)
+		}
+		for _, s := range rt.Ring {
+			inst, ok := hw.Instruments[s.Instrument]
+			if !ok {
+				return nil, fmt.Errorf("route %d: no instrument %q in hardware profile %s", i, s.Instrument, hw.Name)
+			}
+			if _, err := sequences.Get(inst.sequence(s.Sequence)); err != nil {
+				return nil, fmt.Errorf("route %d: %s", i, err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// events returns the names of the events the table routes.
+func (t *routingTable) events() []string {
+	seen := make(map[string]bool)
+	var events []string
+	for _, rt := range t.Routes {
+		if !seen[rt.Event] {
+			seen[rt.Event] = true
+			events = append(events, rt.Event)
+		}
+	}
+	sort.Strings(events)
+	return events
+}
+
+// match returns the strikes for the first route matching event and payload,
+// or nil if none does.
+func (t *routingTable) match(event string, payload map[string]interface{}) []strike {
+	for _, rt := range t.Routes {
+		if rt.Event == event && rt.matches(payload) {
+			return rt.Ring
+		}
+	}
+	return nil
+}
+
+func (rt *route) matches(payload map[string]interface{}) bool {
+	for field, cond := range rt.Where {
+		v, ok := lookupField(payload, field)
+		if !cond.holds(v, ok) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupField returns the value of the dotted field path in payload.
+func lookupField(payload map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = payload
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (c *condition) holds(v interface{}, present bool) bool {
+	if c.Exists != nil && *c.Exists != present {
+		return false
+	}
+	if c.Eq != nil && !(present && equalValues(v, c.Eq)) {
+		return false
+	}
+	if c.Ne != nil && present && equalValues(v, c.Ne) {
+		return false
+	}
+	if c.In != nil {
+		found := false
+		for _, want := range c.In {
+			if present && equalValues(v, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.Gt == nil && c.Gte == nil && c.Lt == nil && c.Lte == nil {
+		return true
+	}
+	n, ok := number(v)
+	switch {
+	case !present || !ok:
+		return false
+	case c.Gt != nil && !(n > *c.Gt),
+		c.Gte != nil && !(n >= *c.Gte),
+		c.Lt != nil && !(n < *c.Lt),
+		c.Lte != nil && !(n <= *c.Lte):
+		return false
+	}
+	return true
+}
+
+// equalValues compares decoded JSON values. Numbers compare by value, even
+// when one of them is a numeric string such as "450000".
+func equalValues(a, b interface{}) bool {
+	if _, aStr := a.(string); aStr {
+		if _, bStr := b.(string); bStr {
+			return a == b
+		}
+	}
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return x == y
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// number returns v as a float64 if it is a number or a numeric string.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// eventHandlers registers handlers for a channel's events, as a
+// *phoenix.Channel does.
+type eventHandlers interface {
+	On(event string, h phoenix.EventHandler)
+	Off(event string)
+}
+
+// router keeps the routing table loaded from a file and the channel handlers
+// for the events it routes in step. Reload swaps in a new table while running.
+type router struct {
+	path      string
+	sequences choreography.Library
+	hw        *profile
+	ch        eventHandlers
+	// handler is registered for every routed event.
+	handler phoenix.EventHandler
+
+	mu     sync.Mutex
+	table  *routingTable
+	events []string
+}
+
+// Reload reads the routing table again, or the default table if there is no
+// file, and registers the handler for the events it routes. On error the
+// current table is kept.
+func (r *router) Reload() error {
+	data, source := []byte(defaultRoutes), "default routes"
+	if r.path != "" {
+		var err error
+		if data, err = ioutil.ReadFile(r.path); err != nil {
+			return err
+		}
+		source = r.path
+	}
+	table, err := parseRoutes(data, r.hw, r.sequences)
+	if err != nil {
+		return fmt.Errorf("%s: %s", source, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Register the new events before dropping the old ones, so that events
+	// routed by both tables are never without a handler.
+	events := table.events()
+	routed := make(map[string]bool)
+	for _, event := range events {
+		routed[event] = true
+		r.ch.On(event, r.handler)
+	}
+	for _, event := range r.events {
+		if !routed[event] {
+			r.ch.Off(event)
+		}
+	}
+	r.table, r.events = table, events
+	log.Printf("routing %d events: %s", len(events), strings.Join(events, ", "))
+	return nil
+}
+
+// Route returns the strikes for evt, or nil if no route matches.
+func (r *router) Route(evt *phoenix.Event) ([]strike, error) {
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(evt.Payload, &payload); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	table := r.table
+	r.mu.Unlock()
+	return table.match(evt.Event, payload), nil
+}
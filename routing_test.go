@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opendoor-labs/gong/choreography"
+	"github.com/opendoor-labs/gong/phoenix"
+)
+
+func testProfile(t *testing.T) *profile {
+	profiles, err := loadProfiles("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hw, err := profiles.selectProfile("original", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hw
+}
+
+func TestConditions(t *testing.T) {
+	payload := map[string]interface{}{}
+	err := json.Unmarshal([]byte(`{
+		"market": "phoenix",
+		"price": 450000,
+		"sqft": "1800",
+		"address": {"city": "Mesa"},
+		"tags": null
+	}`), &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field string
+		cond  string
+		want  bool
+	}{
+		{"market", `"phoenix"`, true},
+		{"market", `"dallas"`, false},
+		{"market", `{"eq": "phoenix"}`, true},
+		{"market", `{"eq": "dallas"}`, false},
+		{"missing", `{"eq": "phoenix"}`, false},
+		{"price", `450000`, true},
+		{"price", `"450000"`, true},
+		{"sqft", `1800`, true},
+		{"address.city", `"Mesa"`, true},
+		{"address.zip", `"85201"`, false},
+		{"market.city", `"Mesa"`, false},
+
+		{"market", `{"ne": "dallas"}`, true},
+		{"market", `{"ne": "phoenix"}`, false},
+		{"missing", `{"ne": "phoenix"}`, true},
+
+		{"market", `{"in": ["dallas", "phoenix"]}`, true},
+		{"market", `{"in": ["dallas", "atlanta"]}`, false},
+		{"price", `{"in": [450000, 500000]}`, true},
+		{"missing", `{"in": ["phoenix"]}`, false},
+
+		{"market", `{"exists": true}`, true},
+		{"market", `{"exists": false}`, false},
+		{"missing", `{"exists": true}`, false},
+		{"missing", `{"exists": false}`, true},
+		{"tags", `{"exists": true}`, true},
+
+		{"price", `{"gt": 449999}`, true},
+		{"price", `{"gt": 450000}`, false},
+		{"price", `{"gte": 450000}`, true},
+		{"price", `{"gte": 450001}`, false},
+		{"price", `{"lt": 450001}`, true},
+		{"price", `{"lt": 450000}`, false},
+		{"price", `{"lte": 450000}`, true},
+		{"price", `{"lte": 449999}`, false},
+		{"price", `{"gte": 400000, "lt": 500000}`, true},
+		{"price", `{"gte": 400000, "lt": 450000}`, false},
+		{"sqft", `{"gt": 1000}`, true},
+		{"market", `{"gt": 0}`, false},
+		{"missing", `{"lt": 0}`, false},
+	}
+	for _, tt := range tests {
+		var c condition
+		if err := json.Unmarshal([]byte(tt.cond), &c); err != nil {
+			t.Errorf("%s %s: %s", tt.field, tt.cond, err)
+			continue
+		}
+		v, ok := lookupField(payload, tt.field)
+		if got := c.holds(v, ok); got != tt.want {
+			t.Errorf("%s %s = %v, want %v", tt.field, tt.cond, got, tt.want)
+		}
+	}
+}
+
+func TestParseRoutesErrors(t *testing.T) {
+	tests := []struct {
+		routes string
+		err    string
+	}{
+		{`{"routes": [{"ring": [{"instrument": "bell"}]}]}`, "no event"},
+		{`{"routes": [{"event": "system_test", "ring": [{"instrument": "bell"}]}]}`, "system_test cannot be routed"},
+		{`{"routes": [{"event": "sale", "ring": [{"instrument": "gong"}]}]}`, `no instrument "gong"`},
+		{`{"routes": [{"event": "sale", "ring": [{"instrument": "bell", "sequence": "fanfare"}]}]}`, `no sequence "fanfare"`},
+		{`{"routes": [{"event": "sale", "where": {"price": {"between": [1, 2]}}, "ring": []}]}`, `unknown condition operator "between"`},
+		{`{"routes": [{"event": "sale", "where": {"market": null}, "ring": []}]}`, "null condition"},
+		{`{"routes": [{"event": "sale", "where": {"market": {"eq": null}}, "ring": []}]}`, `null value for condition operator "eq"`},
+	}
+	hw := testProfile(t)
+	for _, tt := range tests {
+		_, err := parseRoutes([]byte(tt.routes), hw, choreography.Defaults())
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.routes, err, tt.err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	table, err := parseRoutes([]byte(`{"routes": [
+		{"event": "acquisition_contract", "where": {"price": {"gte": 500000}},
+		 "ring": [{"instrument": "bell", "sequence": "chime"}, {"instrument": "chime"}]},
+		{"event": "acquisition_contract", "ring": [{"instrument": "bell"}]}
+	]}`), testProfile(t), choreography.Defaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := table.events(), []string{"acquisition_contract"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		event   string
+		payload map[string]interface{}
+		want    []strike
+	}{
+		{"acquisition_contract", map[string]interface{}{"price": 600000.0}, []strike{{"bell", "chime"}, {"chime", ""}}},
+		{"acquisition_contract", map[string]interface{}{"price": 400000.0}, []strike{{"bell", ""}}},
+		{"resale_contract", map[string]interface{}{}, nil},
+	}
+	for _, tt := range tests {
+		if got := table.match(tt.event, tt.payload); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("match(%s, %v) = %v, want %v", tt.event, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := phoenix.InitClient("ws://localhost/socket/websocket", nil, nil)
+	rt := &router{
+		sequences: choreography.Defaults(),
+		hw:        testProfile(t),
+		ch:        client.Channel(topicName),
+		handler:   func(*phoenix.Event) {},
+	}
+	if err := rt.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	strikes, err := rt.Route(&phoenix.Event{Event: "resale_contract", Payload: []byte(`{}`)})
+	if err != nil || !reflect.DeepEqual(strikes, []strike{{Instrument: "chime"}}) {
+		t.Errorf("default route = %v, %v", strikes, err)
+	}
+
+	rt.path = filepath.Join(dir, "routes.json")
+	if err := ioutil.WriteFile(rt.path, []byte(`{"routes": [{"event": "resale_contract", "ring": [{"instrument": "bell"}]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	strikes, err = rt.Route(&phoenix.Event{Event: "resale_contract", Payload: []byte(`{}`)})
+	if err != nil || !reflect.DeepEqual(strikes, []strike{{Instrument: "bell"}}) {
+		t.Errorf("reloaded route = %v, %v", strikes, err)
+	}
+
+	// a bad file keeps the current table
+	if err := ioutil.WriteFile(rt.path, []byte(`{"routes": [{"event": "resale_contract", "ring": [{"instrument": "gong"}]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Reload(); err == nil || !strings.HasPrefix(err.Error(), rt.path+": ") {
+		t.Errorf("Reload of bad file: %v", err)
+	}
+	if strikes, _ = rt.Route(&phoenix.Event{Event: "resale_contract", Payload: []byte(`{}`)}); !reflect.DeepEqual(strikes, []strike{{Instrument: "bell"}}) {
+		t.Errorf("route after failed reload = %v", strikes)
+	}
+
+	// errors in the default routes say so
+	rt.path = ""
+	rt.hw = &profile{Name: "empty"}
+	if err := rt.Reload(); err == nil || !strings.HasPrefix(err.Error(), "default routes: ") {
+		t.Errorf("Reload of default routes on empty profile: %v", err)
+	}
+}
+
+// handlerLog records the events a router registers, and which of them were
+// ever unregistered.
+type handlerLog struct {
+	registered map[string]bool
+	dropped    map[string]bool
+}
+
+func (l *handlerLog) On(event string, h phoenix.EventHandler) { l.registered[event] = true }
+
+func (l *handlerLog) Off(event string) {
+	delete(l.registered, event)
+	l.dropped[event] = true
+}
+
+func TestReloadKeepsHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	resales := filepath.Join(dir, "resales.json")
+	if err := ioutil.WriteFile(resales, []byte(`{"routes": [{"event": "resale_contract", "ring": [{"instrument": "bell"}]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &handlerLog{registered: map[string]bool{}, dropped: map[string]bool{}}
+	rt := &router{
+		sequences: choreography.Defaults(),
+		hw:        testProfile(t),
+		ch:        l,
+		handler:   func(*phoenix.Event) {},
+	}
+	// the default routes, then resales only, then the default routes again
+	for _, path := range []string{"", resales, ""} {
+		rt.path = path
+		if err := rt.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if path == resales && !reflect.DeepEqual(l.registered, map[string]bool{"resale_contract": true}) {
+			t.Errorf("registered %v with only resales routed", l.registered)
+		}
+	}
+	// resales are routed by every table, so they never lose their handler
+	if want := map[string]bool{"acquisition_contract": true}; !reflect.DeepEqual(l.dropped, want) {
+		t.Errorf("unregistered %v across reloads, want %v", l.dropped, want)
+	}
+	if want := map[string]bool{"acquisition_contract": true, "resale_contract": true}; !reflect.DeepEqual(l.registered, want) {
+		t.Errorf("registered %v, want %v", l.registered, want)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/choreography"
+)
+
+const (
+	// maxQueuedStrikes caps the strikes waiting on one instrument; more are
+	// dropped.
+	maxQueuedStrikes = 10
+	// maxRoll caps how many queued strikes of the same sequence are played
+	// together as one roll.
+	maxRoll = 5
+	// coalesceWindow is how long an idle instrument waits for more strikes
+	// after one arrives, so that a burst starting while it is idle is played
+	// as one roll. Each strike in the burst restarts the wait.
+	coalesceWindow = 500 * time.Millisecond
+)
+
+// chip serializes access to the servo controller shared by every
+// instrument. Waking and sleeping the controller affect all of its channels,
+// so the chip is kept awake while any instrument's session wants it awake.
+type chip struct {
+	mu    sync.Mutex
+	dev   choreography.Controller
+	awake int
+}
+
+// session is one instrument's view of the chip.
+type session struct {
+	chip  *chip
+	awake bool
+}
+
+func (s *session) Wake() error {
+	s.chip.mu.Lock()
+	defer s.chip.mu.Unlock()
+	if s.awake {
+		return nil
+	}
+	if s.chip.awake == 0 {
+		if err := s.chip.dev.Wake(); err != nil {
+			return err
+		}
+	}
+	s.awake = true
+	s.chip.awake++
+	return nil
+}
+
+// Sleep puts the controller to sleep unless another session still wants it
+// awake.
+func (s *session) Sleep() error {
+	s.chip.mu.Lock()
+	defer s.chip.mu.Unlock()
+	if s.awake {
+		s.awake = false
+		s.chip.awake--
+	}
+	if s.chip.awake > 0 {
+		return nil
+	}
+	return s.chip.dev.Sleep()
+}
+
+func (s *session) SetPwm(channel, onTime, offTime int) error {
+	s.chip.mu.Lock()
+	defer s.chip.mu.Unlock()
+	return s.chip.dev.SetPwm(channel, onTime, offTime)
+}
+
+// queuedStrike is a run of strikes of the same sequence waiting to be played
+// as a roll.
+type queuedStrike struct {
+	sequence string
+	count    int
+}
+
+// instrumentQueue holds the strikes waiting on one instrument, which are
+// played in order by its own goroutine.
+type instrumentQueue struct {
+	name   string
+	inst   *instrument
+	player *choreography.Player
+
+	mu      sync.Mutex
+	pending []queuedStrike
+	queued  int
+	playing bool
+	// ready is signaled when strikes are added.
+	ready chan struct{}
+}
+
+// enqueue adds a strike of sequence, coalescing it into the last run if that
+// is of the same sequence. It reports false if the queue is full.
+func (q *instrumentQueue) enqueue(sequence string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued >= maxQueuedStrikes {
+		return false
+	}
+	q.queued++
+	if n := len(q.pending); n > 0 && q.pending[n-1].sequence == sequence && q.pending[n-1].count < maxRoll {
+		q.pending[n-1].count++
+	} else {
+		q.pending = append(q.pending, queuedStrike{sequence: sequence, count: 1})
+	}
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// next removes the first run of strikes from the queue to be played.
+func (q *instrumentQueue) next() (queuedStrike, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.playing = len(q.pending) > 0
+	if !q.playing {
+		return queuedStrike{}, false
+	}
+	s := q.pending[0]
+	q.pending = q.pending[1:]
+	q.queued -= s.count
+	return s, true
+}
+
+// full reports whether the first run of strikes cannot grow any more.
+func (q *instrumentQueue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) > 1 || len(q.pending) == 1 && q.pending[0].count >= maxRoll
+}
+
+// busy reports whether strikes are queued or playing.
+func (q *instrumentQueue) busy() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued > 0 || q.playing
+}
+
+// Strike queues a strike of the sequence called sequence, or the
+// instrument's default, on the instrument called name. It returns without
+// waiting for the strike to be played.
+func (r *ringer) Strike(name, sequence string) error {
+	q, ok := r.queues[name]
+	if !ok {
+		return fmt.Errorf("no instrument %s in hardware profile %s", name, r.hw.Name)
+	}
+	if !q.enqueue(q.inst.sequence(sequence)) {
+		return fmt.Errorf("%s has %d strikes queued, dropping one", name, maxQueuedStrikes)
+	}
+	return nil
+}
+
+// StrikeAfter queues a strike like Strike, after d.
+func (r *ringer) StrikeAfter(d time.Duration, name, sequence string) {
+	r.mu.Lock()
+	r.delayed++
+	r.mu.Unlock()
+	time.AfterFunc(d, func() {
+		if err := r.Strike(name, sequence); err != nil {
+			log.Print(err)
+		}
+		r.mu.Lock()
+		r.delayed--
+		r.mu.Unlock()
+	})
+}
+
+// Busy reports whether any strikes are waiting or playing.
+func (r *ringer) Busy() bool {
+	r.mu.Lock()
+	delayed := r.delayed
+	r.mu.Unlock()
+	if delayed > 0 {
+		return true
+	}
+	for _, q := range r.queues {
+		if q.busy() {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait waits for the instruments to finish the strikes they are playing
+// once ctx is done.
+func (r *ringer) Wait() {
+	r.wg.Wait()
+}
+
+// playQueue plays the strikes queued on q until ctx is done.
+func (r *ringer) playQueue(ctx context.Context, q *instrumentQueue) {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.ready:
+		}
+		if !r.gather(ctx, q) {
+			return
+		}
+		for {
+			s, ok := q.next()
+			if !ok {
+				break
+			}
+			r.play(q, s)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// gather waits until no strike has been added to q for coalesceWindow, or its
+// first run is full. It reports false if ctx is done first.
+func (r *ringer) gather(ctx context.Context, q *instrumentQueue) bool {
+	t := time.NewTimer(coalesceWindow)
+	defer t.Stop()
+	for !q.full() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-q.ready:
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(coalesceWindow)
+		case <-t.C:
+			return true
+		}
+	}
+	return true
+}
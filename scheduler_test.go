@@ -0,0 +1,185 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/kidoman/embd/controller/pca9685"
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/choreography"
+	"github.com/opendoor-labs/gong/pca9685sim"
+)
+
+func TestEnqueue(t *testing.T) {
+	q := &instrumentQueue{ready: make(chan struct{}, 1)}
+	for _, seq := range []string{"bell", "bell", "bell", "chime", "bell", "bell", "bell", "bell", "bell", "bell"} {
+		if !q.enqueue(seq) {
+			t.Fatalf("enqueue %s failed with %d queued", seq, q.queued)
+		}
+	}
+	if q.enqueue("bell") {
+		t.Errorf("enqueue succeeded with %d queued", maxQueuedStrikes)
+	}
+	want := []queuedStrike{{"bell", 3}, {"chime", 1}, {"bell", maxRoll}, {"bell", 1}}
+	if !reflect.DeepEqual(q.pending, want) {
+		t.Fatalf("pending = %v, want %v", q.pending, want)
+	}
+
+	for i, w := range want {
+		// only the last run can still grow
+		if last := i == len(want)-1; q.full() == last {
+			t.Errorf("run %d: full = %v with %d runs left", i, !last, len(want)-i)
+		}
+		if !q.busy() {
+			t.Errorf("run %d: queue not busy", i)
+		}
+		if s, ok := q.next(); !ok || s != w {
+			t.Errorf("run %d = %v, %v; want %v", i, s, ok, w)
+		}
+	}
+	if _, ok := q.next(); ok {
+		t.Error("next returned a run from an empty queue")
+	}
+	if q.busy() || q.queued != 0 {
+		t.Errorf("queue busy with %d queued after the last run", q.queued)
+	}
+}
+
+// simRinger returns a ringer for the original hardware profile on a simulated
+// controller.
+func simRinger(t *testing.T, ctx context.Context) (*ringer, *pca9685sim.Bus) {
+	hw := testProfile(t)
+	bus := pca9685sim.New(hw.Address)
+	dev := pca9685.New(bus.I2CBus(), hw.Address)
+	dev.Freq = hw.Frequency
+	if err := dev.Wake(); err != nil {
+		t.Fatal(err)
+	}
+	return newRinger(ctx, dev, dev.Freq, hw, choreography.Defaults()), bus
+}
+
+// waitIdle waits for r to play every strike queued on it.
+func waitIdle(t *testing.T, r *ringer) {
+	deadline := time.Now().Add(15 * time.Second)
+	for r.Busy() {
+		if time.Now().After(deadline) {
+			t.Fatal("strikes still playing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// outputs returns the widths channel output on bus, skipping the intermediate
+// ones while the driver sets the channel's registers one by one.
+func outputs(bus *pca9685sim.Bus, channel int) []pca9685sim.Sample {
+	var out []pca9685sim.Sample
+	for _, s := range bus.Timeline() {
+		switch {
+		case s.Channel != channel:
+		case len(out) > 0 && s.At-out[len(out)-1].At < 5*time.Millisecond:
+			out[len(out)-1].Width = s.Width
+		default:
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// strikes counts the times channel moved to a pulse of counts out of 4096
+// and when it was turned off.
+func strikes(bus *pca9685sim.Bus, channel, counts int) (n int, off []time.Duration) {
+	perCount := 1 / (bus.Frequency() * 4096)
+	for _, s := range outputs(bus, channel) {
+		switch {
+		case s.Width == 0:
+			off = append(off, s.At)
+		case int(math.Floor(s.Width.Seconds()/perCount+0.5)) == counts:
+			n++
+		}
+	}
+	return n, off
+}
+
+func TestBurstFromIdleRollsOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r, bus := simRinger(t, ctx)
+	defer func() {
+		cancel()
+		r.Wait()
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := r.Strike("bell", ""); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(coalesceWindow / 3)
+	}
+	waitIdle(t, r)
+
+	n, off := strikes(bus, 5, 650)
+	if n != 3 {
+		t.Errorf("bell struck %d times, want 3", n)
+	}
+	if len(off) != 1 {
+		t.Errorf("controller put to sleep %d times, want once after the roll", len(off))
+	}
+}
+
+func TestSeparateStrikes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r, bus := simRinger(t, ctx)
+	defer func() {
+		cancel()
+		r.Wait()
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := r.Strike("bell", ""); err != nil {
+			t.Fatal(err)
+		}
+		waitIdle(t, r)
+	}
+
+	n, off := strikes(bus, 5, 650)
+	if n != 2 || len(off) != 2 {
+		t.Errorf("bell struck %d times and slept %d times, want 2 separate strikes", n, len(off))
+	}
+}
+
+func TestInstrumentsPlayTogether(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r, bus := simRinger(t, ctx)
+	defer func() {
+		cancel()
+		r.Wait()
+	}()
+
+	start := time.Now()
+	if err := r.Strike("bell", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Strike("chime", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Strike("gong", ""); err == nil {
+		t.Error("struck an instrument the profile lacks")
+	}
+	waitIdle(t, r)
+
+	// the chime's sequence is the longer, at 1.24s; played in turn they
+	// would take over 2s
+	if took := time.Since(start); took > coalesceWindow+1800*time.Millisecond {
+		t.Errorf("bell and chime took %s", took)
+	}
+	bells, bellOff := strikes(bus, 5, 650)
+	chimes, chimeOff := strikes(bus, 6, 330)
+	if bells != 1 || chimes != 2 {
+		t.Errorf("bell struck %d times and chime %d times, want 1 and 2", bells, chimes)
+	}
+	// the controller stays awake until both are done
+	if len(bellOff) != 1 || !reflect.DeepEqual(bellOff, chimeOff) {
+		t.Errorf("bell turned off at %v and chime at %v, want once together", bellOff, chimeOff)
+	}
+}
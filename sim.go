@@ -0,0 +1,475 @@
+//go:build sim
+// +build sim
+
+// The sim command is only built with the sim tag, as it runs an in-process
+// Phoenix server that has no place in the firmware.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/github.com/kidoman/embd/controller/pca9685"
+	"github.com/opendoor-labs/gong/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/opendoor-labs/gong/choreography"
+	"github.com/opendoor-labs/gong/pca9685sim"
+	"github.com/opendoor-labs/gong/phoenix"
+	"github.com/opendoor-labs/gong/phoenix/phoenixtest"
+)
+
+const simUsage = `usage: gong sim [flags] [events.jsonl ...]
+
+Plays Phoenix events through the gong's handlers on a simulated servo
+controller and charts each instrument's pulse width over time, live in the
+terminal or, with -o, as a CSV or SVG file.
+
+Events are read from the given files, one JSON object per line:
+
+	{"event": "acquisition_contract", "payload": {"market": "phoenix"}, "at": "1.5s"}
+
+"at" is when to send the event, from the start; without it an event is sent
+-interval after the one before. Without files, -count synthetic events named
+by -events are sent -interval apart.
+
+Flags:
+`
+
+// simSettle is how long the servos get to reset before the first event, and
+// how long the simulation runs on after the last strike.
+const simSettle = time.Second
+
+// simJoinTimeout is how long the client may take to join the simulated
+// server's topic.
+const simJoinTimeout = 10 * time.Second
+
+// simEvent is an event to replay and when.
+type simEvent struct {
+	at    time.Duration
+	event string
+	topic string
+	body  json.RawMessage
+}
+
+// runSim runs the sim command with args, which exclude the command name.
+func runSim(args []string) {
+	fs := flag.NewFlagSet("sim", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, simUsage)
+		fs.PrintDefaults()
+	}
+	profileName := fs.String("profile", os.Getenv("HARDWARE_PROFILE"), "hardware profile to simulate")
+	routesFile := fs.String("routes", os.Getenv("ROUTES_FILE"), "routing table file")
+	events := fs.String("events", "acquisition_contract,resale_contract", "comma-separated synthetic events to send in turn")
+	payload := fs.String("payload", `{"address": "1 Simulated Way"}`, "payload of synthetic events")
+	count := fs.Int("count", 4, "number of synthetic events")
+	interval := fs.Duration("interval", 2*time.Second, "time between events")
+	out := fs.String("o", "", "write the timeline to this .csv or .svg file instead of charting it live")
+	width := fs.Int("width", 72, "columns of the live chart")
+	window := fs.Duration("window", 8*time.Second, "time span of the live chart")
+	verbose := fs.Bool("v", false, "log while charting live")
+	fs.Parse(args)
+
+	var replay []simEvent
+	var err error
+	if fs.NArg() > 0 {
+		replay, err = readSimEvents(fs.Args(), *interval)
+	} else {
+		replay, err = syntheticEvents(strings.Split(*events, ","), json.RawMessage(*payload), *count, *interval)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	format := strings.TrimPrefix(filepath.Ext(*out), ".")
+	if *out != "" && format != "csv" && format != "svg" {
+		log.Fatalf("can't write %s: the timeline is written as .csv or .svg", *out)
+	}
+
+	sequences, hw, err := loadConfig(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var logs io.Writer = os.Stderr
+	if *out == "" && !*verbose {
+		logs = ioutil.Discard
+	}
+	log.SetOutput(logs)
+	// errors are reported even when logs are not
+	fatal := log.New(os.Stderr, "", log.LstdFlags)
+
+	bus := pca9685sim.New(hw.Address)
+	chart := &simChart{bus: bus, hw: hw, begin: time.Now()}
+	dev := pca9685.New(bus.I2CBus(), hw.Address)
+	dev.Freq = hw.Frequency
+	if err := dev.Wake(); err != nil {
+		fatal.Fatal("waking: ", err)
+	}
+	if err := resetAllChannels(dev, hw); err != nil {
+		fatal.Fatal("resetting channels: ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := phoenixtest.NewServer()
+	defer server.Close()
+	logger := phoenix.NewStdLogger(log.New(logs, "phoenix: ", log.LstdFlags), phoenix.LevelWarn)
+	client := phoenix.InitClient(server.URL, []string{topicName}, []byte("{}"), phoenix.WithLogger(logger))
+
+	r := newRinger(ctx, dev, dev.Freq, hw, sequences)
+	defer func() {
+		cancel()
+		r.Wait()
+	}()
+	_, clientDone, err := connect(ctx, client, r, *routesFile, "")
+	if err != nil {
+		fatal.Fatal("loading routes: ", err)
+	}
+	defer func() {
+		cancel()
+		<-clientDone
+	}()
+	contracts := client.Channel(topicName)
+	go func() {
+		for range client.Events() {
+		}
+	}()
+
+	chart.width, chart.window = *width, *window
+	done := make(chan struct{})
+	if *out == "" {
+		go chart.live(os.Stdout, done)
+	}
+
+	time.Sleep(simSettle)
+	if err := dev.Sleep(); err != nil {
+		fatal.Fatal(err)
+	}
+	joinDeadline := time.Now().Add(simJoinTimeout)
+	for contracts.State() != phoenix.TopicJoined {
+		if time.Now().After(joinDeadline) {
+			fatal.Fatalf("%s not joined on the simulated server after %s", topicName, simJoinTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	for i := range replay {
+		evt := &replay[i]
+		time.Sleep(evt.at - time.Since(start))
+		if _, err := server.Broadcast(evt.topic, evt.event, &evt.body); err != nil {
+			fatal.Fatal(err)
+		}
+	}
+	// give the last event time to reach the handlers, then let the strikes
+	// play out
+	time.Sleep(simSettle)
+	for r.Busy() {
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(simSettle)
+	close(done)
+
+	if *out == "" {
+		chart.draw(os.Stdout, time.Since(chart.begin))
+		return
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if format == "csv" {
+		err = chart.writeCSV(f)
+	} else {
+		err = chart.writeSVG(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalf("writing %s: %s", *out, err)
+	}
+}
+
+// readSimEvents reads recorded events from files, in order.
+func readSimEvents(paths []string, interval time.Duration) ([]simEvent, error) {
+	var events []simEvent
+	var at time.Duration
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			data := strings.TrimSpace(scanner.Text())
+			if data == "" {
+				continue
+			}
+			rec := struct {
+				Topic   string                 `json:"topic"`
+				Event   string                 `json:"event"`
+				Payload json.RawMessage        `json:"payload"`
+				At      *choreography.Duration `json:"at"`
+			}{}
+			if err := json.Unmarshal([]byte(data), &rec); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+			if rec.Event == "" {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: no event", path, line)
+			}
+			switch {
+			case rec.At != nil:
+				at = time.Duration(*rec.At)
+			case len(events) > 0:
+				at += interval
+			}
+			if rec.Topic == "" {
+				rec.Topic = topicName
+			}
+			if len(rec.Payload) == 0 {
+				rec.Payload = json.RawMessage("{}")
+			}
+			events = append(events, simEvent{at: at, event: rec.Event, topic: rec.Topic, body: rec.Payload})
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	sort.Stable(simEventsByTime(events))
+	return events, nil
+}
+
+type simEventsByTime []simEvent
+
+func (s simEventsByTime) Len() int           { return len(s) }
+func (s simEventsByTime) Less(i, j int) bool { return s[i].at < s[j].at }
+func (s simEventsByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// syntheticEvents returns count events cycling through names, interval apart.
+func syntheticEvents(names []string, payload json.RawMessage, count int, interval time.Duration) ([]simEvent, error) {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, fmt.Errorf("synthetic payload: %s", err)
+	}
+	var events []simEvent
+	for i := 0; i < count; i++ {
+		name := strings.TrimSpace(names[i%len(names)])
+		events = append(events, simEvent{at: time.Duration(i) * interval, event: name, topic: topicName, body: payload})
+	}
+	return events, nil
+}
+
+// simChart charts the pulse widths of a profile's instruments recorded by a
+// simulated bus.
+type simChart struct {
+	bus *pca9685sim.Bus
+	hw  *profile
+	// begin is about when the bus recorded its first sample, which sample
+	// times count from.
+	begin  time.Time
+	width  int
+	window time.Duration
+}
+
+// simLevels draw pulse widths from the bottom to the top of an instrument's
+// range.
+var simLevels = []rune("▁▂▃▄▅▆▇█")
+
+// simRow is one instrument's line of the chart.
+type simRow struct {
+	name    string
+	channel int
+	// lo and hi bound the instrument's pulse width.
+	lo, hi  time.Duration
+	samples []pca9685sim.Sample
+}
+
+// rows returns the chart's rows, one per instrument, with the samples
+// recorded so far.
+func (c *simChart) rows() []simRow {
+	// one count of the PWM period
+	count := time.Duration(1e9 / (c.bus.Frequency() * 4096))
+	byChannel := make(map[int][]pca9685sim.Sample)
+	for _, s := range c.bus.Timeline() {
+		byChannel[s.Channel] = append(byChannel[s.Channel], s)
+	}
+	var rows []simRow
+	for _, name := range c.hw.instrumentNames() {
+		inst := c.hw.Instruments[name]
+		lo, hi := inst.Min, inst.Max
+		if hi == 0 {
+			lo, hi = inst.Rest, inst.Strike
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		rows = append(rows, simRow{
+			name:    name,
+			channel: inst.Channel,
+			lo:      time.Duration(lo) * count,
+			hi:      time.Duration(hi) * count,
+			samples: byChannel[inst.Channel],
+		})
+	}
+	return rows
+}
+
+// widthAt returns the row's pulse width at t.
+func (row *simRow) widthAt(t time.Duration) time.Duration {
+	i := sort.Search(len(row.samples), func(i int) bool { return row.samples[i].At > t })
+	if i == 0 {
+		return 0
+	}
+	return row.samples[i-1].Width
+}
+
+// level returns where width lies in the row's range, from 0 to 1.
+func (row *simRow) level(width time.Duration) float64 {
+	if row.hi <= row.lo {
+		return 1
+	}
+	l := float64(width-row.lo) / float64(row.hi-row.lo)
+	switch {
+	case l < 0:
+		return 0
+	case l > 1:
+		return 1
+	}
+	return l
+}
+
+// live redraws the chart until done is closed.
+func (c *simChart) live(w io.Writer, done <-chan struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.draw(w, time.Since(c.begin))
+		}
+	}
+}
+
+// draw clears the terminal and draws the window of the chart ending at now.
+func (c *simChart) draw(w io.Writer, now time.Duration) {
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&buf, "gong sim: hardware profile %s, %.0f Hz, t=%.1fs\n\n", c.hw.Name, c.bus.Frequency(), now.Seconds())
+	step := c.window / time.Duration(c.width)
+	for _, row := range c.rows() {
+		fmt.Fprintf(&buf, "%-10s ch%-2d |", row.name, row.channel)
+		for i := 1; i <= c.width; i++ {
+			width := row.widthAt(now - c.window + time.Duration(i)*step)
+			if width == 0 {
+				buf.WriteByte(' ')
+				continue
+			}
+			buf.WriteRune(simLevels[int(row.level(width)*float64(len(simLevels)-1)+0.5)])
+		}
+		current := "off"
+		if width := row.widthAt(now); width != 0 {
+			current = fmt.Sprintf("%.3fms", width.Seconds()*1000)
+		}
+		fmt.Fprintf(&buf, "| %s\n", current)
+	}
+	label := fmt.Sprintf("-%s", c.window)
+	fmt.Fprintf(&buf, "%16s%-*s%s\n", "", c.width+1-len("now"), label, "now")
+	io.WriteString(w, buf.String())
+}
+
+// writeCSV writes every sample recorded, one per row.
+func (c *simChart) writeCSV(w io.Writer) error {
+	names := make(map[int]string)
+	for name, inst := range c.hw.Instruments {
+		names[inst.Channel] = name
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time_ms", "channel", "instrument", "pulse_width_us"})
+	for _, s := range c.bus.Timeline() {
+		cw.Write([]string{
+			strconv.FormatFloat(s.At.Seconds()*1000, 'f', 3, 64),
+			strconv.Itoa(s.Channel),
+			names[s.Channel],
+			strconv.FormatFloat(s.Width.Seconds()*1e6, 'f', 1, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// SVG layout, in pixels.
+const (
+	svgPerSecond = 200
+	svgRow       = 80
+	svgLabel     = 120
+	svgMargin    = 20
+)
+
+// writeSVG draws the whole timeline as a step chart per instrument.
+func (c *simChart) writeSVG(w io.Writer) error {
+	rows := c.rows()
+	var end time.Duration
+	for _, row := range rows {
+		if n := len(row.samples); n > 0 && row.samples[n-1].At > end {
+			end = row.samples[n-1].At
+		}
+	}
+	end += simSettle
+	x := func(t time.Duration) float64 { return svgLabel + t.Seconds()*svgPerSecond }
+	width := x(end) + svgMargin
+	height := svgMargin*2 + svgRow*len(rows) + 20
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%d" font-family="monospace" font-size="12">`+"\n", width, height)
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="white"/>`+"\n")
+	axis := svgMargin + svgRow*len(rows)
+	for s := 0; time.Duration(s)*time.Second <= end; s++ {
+		sx := x(time.Duration(s) * time.Second)
+		fmt.Fprintf(&buf, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#ddd"/>`+"\n", sx, svgMargin, sx, axis)
+		fmt.Fprintf(&buf, `<text x="%.1f" y="%d" text-anchor="middle">%ds</text>`+"\n", sx, axis+15, s)
+	}
+	for i, row := range rows {
+		top := svgMargin + i*svgRow
+		// widths run from 80% of the row's height at lo to 10% at hi; off is
+		// drawn at its bottom
+		y := func(width time.Duration) float64 {
+			if width == 0 {
+				return float64(top + svgRow)
+			}
+			return float64(top) + svgRow*(0.8-0.7*row.level(width))
+		}
+		fmt.Fprintf(&buf, `<text x="4" y="%d">%s ch%d</text>`+"\n", top+svgRow/2, html.EscapeString(row.name), row.channel)
+		fmt.Fprintf(&buf, `<text x="4" y="%d" fill="#888">%.2f-%.2fms</text>`+"\n", top+svgRow/2+14, row.lo.Seconds()*1000, row.hi.Seconds()*1000)
+		points := []string{fmt.Sprintf("%.1f,%.1f", x(0), y(0))}
+		last := time.Duration(0)
+		for _, s := range row.samples {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(s.At), y(last)), fmt.Sprintf("%.1f,%.1f", x(s.At), y(s.Width)))
+			last = s.Width
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x(end), y(last)))
+		fmt.Fprintf(&buf, `<polyline fill="none" stroke="#c33" stroke-width="1.5" points="%s"/>`+"\n", strings.Join(points, " "))
+	}
+	buf.WriteString("</svg>\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
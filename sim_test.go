@@ -0,0 +1,51 @@
+//go:build sim
+// +build sim
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opendoor-labs/gong/choreography"
+	"github.com/opendoor-labs/gong/pca9685sim"
+)
+
+func TestWriteSVGEscapesNames(t *testing.T) {
+	bus := pca9685sim.New(0x40)
+	bus.WriteToReg(0x40, 0x00, []byte{0x20}) // awake, auto-increment
+	bus.WriteToReg(0x40, 0x06, []byte{0, 0, 0x30, 0x01})
+	c := &simChart{
+		bus: bus,
+		hw: &profile{Instruments: map[string]*instrument{
+			`<bell> & "chime"`: {Instrument: choreography.Instrument{Channel: 0, Rest: 200, Strike: 400}},
+		}},
+		begin: time.Now(),
+	}
+	var buf bytes.Buffer
+	if err := c.writeSVG(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var text []string
+	d := xml.NewDecoder(&buf)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("chart is not well-formed: %s", err)
+		}
+		if data, ok := tok.(xml.CharData); ok {
+			text = append(text, string(data))
+		}
+	}
+	if !strings.Contains(strings.Join(text, "\n"), `<bell> & "chime" ch0`) {
+		t.Errorf("instrument name not in chart text %q", text)
+	}
+}